@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/LandaMm/hsp-go/hsp"
+)
+
+// Client random is sent within the first bytes of every handshake
+const handshakeSearchWindow = 128
+
+// replayConn feeds captured bytes to hsp.Connection, which only reads
+// from the underlying connection while decoding
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// Decode prints packets of captured traffic, decrypted with keys from the
+// key log. Capture is either a pcap file or raw dump of a TCP stream.
+func Decode(args []string) {
+	flags := flag.NewFlagSet("decode", flag.ExitOnError)
+
+	var keyLogFile string
+	flags.StringVar(&keyLogFile, "keylog", os.Getenv("HSPKEYLOGFILE"), "key log written by client or server")
+
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s decode -keylog <file> <capture.pcap|stream.bin>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || len(keyLogFile) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	file, err := os.Open(keyLogFile)
+	if err != nil {
+		fmt.Println("ERR: Failed to open key log:", err)
+		return
+	}
+
+	entries, err := hsp.ReadKeyLog(file)
+	file.Close()
+	if err != nil {
+		fmt.Println("ERR: Invalid key log:", err)
+		return
+	}
+
+	data, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Println("ERR: Failed to read capture:", err)
+		return
+	}
+
+	if !IsPcap(data) {
+		DecodeRawStream(data, entries)
+		return
+	}
+
+	flows, err := ReadPcap(data)
+	if err != nil {
+		fmt.Println("ERR: Invalid capture:", err)
+		return
+	}
+
+	DecodeFlows(flows, entries)
+}
+
+func DecodeFlows(flows []*TcpFlow, entries []*hsp.KeyLogEntry) {
+	byName := make(map[string]*TcpFlow)
+	for _, flow := range flows {
+		byName[flow.Src+"->"+flow.Dst] = flow
+	}
+
+	decoded := make(map[*TcpFlow]bool)
+
+	for _, flow := range flows {
+		if decoded[flow] {
+			continue
+		}
+
+		data := flow.Data()
+
+		entry := findEntry(data, entries)
+		if entry == nil {
+			if findPacket(data, 0) >= 0 {
+				fmt.Printf("WARN: No keys for %s -> %s\n", flow.Src, flow.Dst)
+			}
+			continue
+		}
+
+		decoded[flow] = true
+		fmt.Printf("=== %s -> %s (client)\n", flow.Src, flow.Dst)
+		DecodeStream(data, entry.ClientKey, entry.Suite)
+
+		if reverse, ok := byName[flow.Reverse()]; ok {
+			decoded[reverse] = true
+			fmt.Printf("=== %s -> %s (server)\n", reverse.Src, reverse.Dst)
+			DecodeStream(reverse.Data(), entry.ServerKey, entry.Suite)
+		}
+	}
+}
+
+// DecodeRawStream decodes a single direction of a connection. Client's
+// stream is recognized by the handshake, otherwise every logged key is tried.
+func DecodeRawStream(data []byte, entries []*hsp.KeyLogEntry) {
+	if entry := findEntry(data, entries); entry != nil {
+		fmt.Println("=== client")
+		DecodeStream(data, entry.ClientKey, entry.Suite)
+		return
+	}
+
+	start := findPacket(data, 0)
+	if start < 0 {
+		fmt.Println("ERR: No packets found in the stream")
+		return
+	}
+
+	for _, entry := range entries {
+		for _, key := range [][32]byte{entry.ServerKey, entry.ClientKey} {
+			conn := hsp.NewConnection(&replayConn{reader: bytes.NewReader(data[start:])}, nil, [32]byte{}, key)
+			conn.Suite = entry.Suite
+
+			if _, err := conn.Read(); err == nil {
+				fmt.Println("=== stream")
+				DecodeStream(data, key, entry.Suite)
+				return
+			}
+		}
+	}
+
+	fmt.Println("ERR: None of the logged keys decrypts the stream")
+}
+
+// DecodeStream prints every packet found in one direction of a connection,
+// skipping the handshake and any other bytes between packets
+func DecodeStream(data []byte, key [32]byte, suite hsp.CipherSuite) {
+	conn := hsp.NewConnection(nil, nil, [32]byte{}, key)
+	conn.Suite = suite
+
+	var reader *bytes.Reader
+	read := func(offset int) (*hsp.Packet, error) {
+		reader = bytes.NewReader(data[offset:])
+		conn.Conn = &replayConn{reader: reader}
+		return conn.Read()
+	}
+
+	offset := findPacket(data, 0)
+	for offset >= 0 {
+		pkt, err := read(offset)
+
+		// Packets lost from the capture leave a gap in sequence numbers,
+		// which is skipped only if the packet after it decrypts
+		var replay *hsp.ReplayError
+		if errors.As(err, &replay) && replay.Received > replay.Expected {
+			conn.ResyncSequence(replay.Received)
+
+			pkt, err = read(offset)
+			if err == nil {
+				fmt.Printf("WARN: %d packets are missing before offset %d\n", replay.Received-replay.Expected, offset)
+			} else {
+				conn.ResyncSequence(replay.Expected)
+			}
+		}
+
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			fmt.Printf("WARN: Capture ends in the middle of packet at offset %d\n", offset)
+			return
+		}
+
+		if err != nil {
+			fmt.Printf("ERR: Couldn't decode packet at offset %d: %v\n", offset, err)
+			offset = findPacket(data, offset+1)
+			continue
+		}
+
+		fmt.Printf("--- offset %d, flags %s, request id %d\n", offset, hsp.FormatFlags(pkt.Flags), pkt.RequestID)
+		if err := PrintPacket(pkt); err != nil {
+			fmt.Println("ERR: Couldn't print out the packet:", err)
+		}
+
+		offset += int(reader.Size()) - reader.Len()
+		if offset >= len(data) {
+			return
+		}
+
+		next := findPacket(data, offset)
+		if next != offset {
+			skipped := next - offset
+			if next < 0 {
+				skipped = len(data) - offset
+			}
+			fmt.Printf("--- %d raw bytes\n", skipped)
+		}
+		offset = next
+	}
+}
+
+func findEntry(data []byte, entries []*hsp.KeyLogEntry) *hsp.KeyLogEntry {
+	window := data[:min(len(data), handshakeSearchWindow)]
+	for _, entry := range entries {
+		if bytes.Contains(window, entry.ClientRandom[:]) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// findPacket looks for the start of a packet with the supported version
+func findPacket(data []byte, from int) int {
+	marker := binary.BigEndian.AppendUint32(nil, hsp.Magic)
+	marker = append(marker, byte(hsp.PacketVersion))
+
+	if from >= len(data) {
+		return -1
+	}
+
+	index := bytes.Index(data[from:], marker)
+	if index < 0 {
+		return -1
+	}
+	return from + index
+}
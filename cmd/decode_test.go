@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/LandaMm/hsp-go/hsp"
+)
+
+// captureConn records what connection writes, packet by packet
+type captureConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *captureConn) Write(p []byte) (int, error) { return c.buf.Write(p) }
+
+// captureOutput returns everything f prints to standard output
+func captureOutput(t *testing.T, f func()) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal("ERR: Failed to create pipe:", err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	done := make(chan string)
+	go func() {
+		out, _ := io.ReadAll(r)
+		done <- string(out)
+	}()
+
+	f()
+	w.Close()
+
+	return <-done
+}
+
+// sealPackets encrypts text packets as the sender would, returning each
+// of them separately
+func sealPackets(t *testing.T, sendKey [32]byte, texts ...string) [][]byte {
+	t.Helper()
+
+	conn := &captureConn{}
+	sender := hsp.NewConnection(conn, nil, sendKey, [32]byte{})
+
+	var packets [][]byte
+	for _, text := range texts {
+		headers := hsp.Header{hsp.H_ROUTE: {"/decode"}, hsp.H_DATA_FORMAT: {hsp.TextDataFormat().String()}}
+		if _, err := sender.Write(hsp.BuildPacket(headers, []byte(text))); err != nil {
+			t.Fatal("ERR: Failed to write packet:", err)
+		}
+
+		packets = append(packets, bytes.Clone(conn.buf.Bytes()))
+		conn.buf.Reset()
+	}
+
+	return packets
+}
+
+func TestDecodeFlowsWithKeyLog(t *testing.T) {
+	keys, err := hsp.DeriveSessionKeys([]byte("secret"), []byte("transcript"))
+	if err != nil {
+		t.Fatal("ERR: Failed to derive keys:", err)
+	}
+
+	random := [32]byte{1, 2, 3, 4}
+
+	// Server side of the connection logs the keys
+	logger := hsp.NewConnection(nil, nil, keys.ServerToClient, keys.ClientToServer)
+	logger.ClientRandom = random
+
+	var keyLog bytes.Buffer
+	if err := logger.LogKeys(&keyLog); err != nil {
+		t.Fatal("ERR: Failed to log keys:", err)
+	}
+
+	entries, err := hsp.ReadKeyLog(&keyLog)
+	if err != nil {
+		t.Fatal("ERR: Failed to read key log:", err)
+	}
+
+	requests := sealPackets(t, keys.ClientToServer, "first", "lost", "third")
+	responses := sealPackets(t, keys.ServerToClient, "reply")
+
+	// Handshake carries client random, second request is missing in the capture
+	clientData := append(append([]byte("hello"), random[:]...), requests[0]...)
+	lostSize := uint32(len(requests[1]))
+
+	var frames [][]byte
+	seq := uint32(1000)
+	frames = append(frames, ipv4Frame("10.0.0.1", "10.0.0.2", tcpFrame(5000, 998, seq, tcpSyn, "")))
+	frames = append(frames, ipv4Frame("10.0.0.1", "10.0.0.2", tcpFrame(5000, 998, seq+1, tcpAck, string(clientData))))
+	frames = append(frames, ipv4Frame("10.0.0.2", "10.0.0.1", tcpFrame(998, 5000, 1, tcpAck, string(responses[0]))))
+	frames = append(frames, ipv4Frame("10.0.0.1", "10.0.0.2", tcpFrame(5000, 998, seq+1+uint32(len(clientData))+lostSize, tcpAck, string(requests[2]))))
+
+	flows, err := ReadPcap(pcapFile(linkRaw, frames...))
+	if err != nil {
+		t.Fatal("ERR: Failed to read capture:", err)
+	}
+
+	out := captureOutput(t, func() {
+		DecodeFlows(flows, entries)
+	})
+
+	for _, expected := range []string{
+		"=== 10.0.0.1:5000 -> 10.0.0.2:998 (client)",
+		"first",
+		"WARN: 1 packets are missing",
+		"third",
+		"=== 10.0.0.2:998 -> 10.0.0.1:5000 (server)",
+		"reply",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Output doesn't contain %q:\n%s", expected, out)
+		}
+	}
+
+	if strings.Contains(out, "lost") || strings.Contains(out, "ERR:") {
+		t.Errorf("Unexpected output:\n%s", out)
+	}
+
+	if strings.Index(out, "first") > strings.Index(out, "third") {
+		t.Errorf("Packets are out of order:\n%s", out)
+	}
+}
+
+func TestDecodeRawStream(t *testing.T) {
+	keys, err := hsp.DeriveSessionKeys([]byte("secret"), []byte("transcript"))
+	if err != nil {
+		t.Fatal("ERR: Failed to derive keys:", err)
+	}
+
+	entries := []*hsp.KeyLogEntry{{
+		ClientKey: keys.ClientToServer,
+		ServerKey: keys.ServerToClient,
+		Suite:     hsp.SUITE_AES_256_GCM,
+	}}
+
+	// Dump of server's direction, recognized by trying logged keys
+	data := bytes.Join(sealPackets(t, keys.ServerToClient, "one", "two"), nil)
+
+	out := captureOutput(t, func() {
+		DecodeRawStream(data, entries)
+	})
+
+	if !strings.Contains(out, "=== stream") || !strings.Contains(out, "one") || !strings.Contains(out, "two") {
+		t.Errorf("Unexpected output:\n%s", out)
+	}
+}
@@ -25,12 +25,12 @@ type HeaderList struct {
 	Headers []Header
 }
 
-func (hl *HeaderList) Map() map[string]string {
-	headerMap := make(map[string]string)
+func (hl *HeaderList) Map() hsp.Header {
+	headers := make(hsp.Header)
 	for _, header := range hl.Headers {
-		headerMap[header.Key] = header.Value
+		headers.Add(header.Key, header.Value)
 	}
-	return headerMap
+	return headers
 }
 
 func (hl *HeaderList) Set(arg string) error {
@@ -50,15 +50,17 @@ func (hl *HeaderList) String() string {
 }
 
 func PrintPacket(pkt *hsp.Packet) error {
-	fmt.Printf("REQUEST %s\n", pkt.Headers[hsp.H_ROUTE])
+	fmt.Printf("REQUEST %s\n", pkt.Headers.Get(hsp.H_ROUTE))
 	fmt.Println("Headers:")
 
-	for k, v := range pkt.Headers {
-		fmt.Printf("\t%s: %s\n", k, v)
+	for _, k := range pkt.Headers.Keys() {
+		for _, v := range pkt.Headers[k] {
+			fmt.Printf("\t%s: %s\n", k, v)
+		}
 	}
 
-	h, ok := pkt.Headers[hsp.H_DATA_FORMAT]
-	if !ok {
+	h := pkt.Headers.Get(hsp.H_DATA_FORMAT)
+	if !pkt.Headers.Has(hsp.H_DATA_FORMAT) {
 		return fmt.Errorf("data format header is not present")
 	}
 
@@ -115,26 +117,70 @@ func Index(req *hsp.Request) *hsp.Response {
 	return rsp
 }
 
-func StartServer(addr *hsp.Adddress) {
-	srv := server.NewServer(*addr)
+func IndexStream(req *hsp.Request, stream *hsp.Stream) *hsp.Response {
+	fmt.Printf("STREAM %s (%s)\n", req.GetRoute(), stream.Key)
+
+	n, err := io.Copy(io.Discard, stream)
+	if err != nil {
+		fmt.Println("ERR: Couldn't receive the stream:", err)
+		return hsp.NewErrorResponse(err)
+	}
+
+	fmt.Printf("Received %d bytes\n", n)
+
+	return hsp.NewStatusResponse(hsp.STATUS_SUCCESS)
+}
+
+func ParseCipherSuites(list string) ([]hsp.CipherSuite, error) {
+	var suites []hsp.CipherSuite
+	for _, name := range strings.Split(list, ",") {
+		if len(name) == 0 {
+			continue
+		}
+
+		suite, err := hsp.ParseCipherSuite(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+
+		suites = append(suites, suite)
+	}
+	return suites, nil
+}
+
+func ParseHandshake(name string) (hsp.Handshake, error) {
+	switch strings.ToLower(name) {
+	case "", "legacy":
+		return hsp.LegacyHandshake, nil
+	case "xx":
+		return hsp.NoiseXX, nil
+	case "ik":
+		return hsp.NoiseIK, nil
+	default:
+		return nil, fmt.Errorf("unknown handshake: %s", name)
+	}
+}
+
+func StartServer(srv *server.Server) {
 	fmt.Printf("Server created on address: %s\n", srv.Addr.String())
 
-	handler := make(chan *hsp.Connection, 1)
+	if srv.Identity == nil {
+		identity, err := hsp.GenerateKeyPair()
+		if err != nil {
+			fmt.Println("ERR: Failed to generate server identity:", err)
+			return
+		}
+		srv.Identity = identity
+	}
+
+	fmt.Printf("Server identity key: %s (%s)\n", hsp.EncodePublicKey(srv.Identity.Public), hsp.Fingerprint(srv.Identity.Public))
 
 	router := server.NewRouter()
 
 	router.AddRoute("*", Index)
+	router.AddStreamRoute("*", IndexStream)
 
-	srv.SetListener(handler)
-
-	go func() {
-		for {
-			conn := <-handler
-			if err := router.Handle(conn); err != nil {
-				fmt.Println("ERR: Couldn't handle connection:", err.Error())
-			}
-		}
-	}()
+	srv.SetHandler(router)
 
 	sigs := make(chan os.Signal, 1)
 
@@ -157,6 +203,7 @@ func StartServer(addr *hsp.Adddress) {
 
 func StartSession(options *client.ClientOptions) {
 	c := client.NewClient(options)
+	defer c.Close()
 
 	rl, err := readline.New("> ")
 	if err != nil {
@@ -185,7 +232,25 @@ func StartSession(options *client.ClientOptions) {
 		var rsp *hsp.Response
 		var rerr error
 
-		if strings.HasPrefix(line, "/file") {
+		if strings.HasPrefix(line, "/stream ") {
+			filename := strings.TrimSpace(strings.TrimPrefix(line, "/stream "))
+
+			file, err := os.Open(filename)
+			if err != nil {
+				fmt.Printf("ERR: Failed to open file '%s': %v\n", filename, err)
+				continue
+			}
+
+			info, err := file.Stat()
+			if err != nil {
+				fmt.Printf("ERR: Failed to stat file '%s': %v\n", filename, err)
+				file.Close()
+				continue
+			}
+
+			rsp, rerr = c.SendStream(route, file, info.Size())
+			file.Close()
+		} else if strings.HasPrefix(line, "/file") {
 			what := strings.TrimLeft(line, "/file")
 			isJson := false
 			var filename string
@@ -242,6 +307,17 @@ func StartSession(options *client.ClientOptions) {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "decode":
+			Decode(os.Args[2:])
+			return
+		case "keygen":
+			Keygen(os.Args[2:])
+			return
+		}
+	}
+
 	var listening bool
 	flag.BoolVar(&listening, "server", false, "start a simple server")
 
@@ -251,17 +327,78 @@ func main() {
 
 	var headerList HeaderList
 	var auth string
+	var keepAlive bool
+	var serverKey string
+	var knownHosts string
+	var ciphers string
+	var encodedPsk string
+	var handshakeName string
+	var keyLogFile string
+	var identityFile string
 
 	flag.StringVar(&host, "host", "localhost", "specify server host")
 	flag.StringVar(&service, "port", "998", "specify server port")
 	flag.StringVar(&address, "addr", "localhost:998", "specify target address")
 
 	flag.StringVar(&auth, "auth", "", "provide auth credentials")
+	flag.BoolVar(&keepAlive, "keep-alive", true, "reuse connection between requests")
+	flag.StringVar(&serverKey, "server-key", "", "expected identity key of the server")
+	flag.StringVar(&knownHosts, "known-hosts", "", "file of trusted server identity keys")
+	flag.StringVar(&ciphers, "ciphers", "", "comma separated cipher suites in order of preference")
+	flag.StringVar(&handshakeName, "handshake", "legacy", "key exchange: legacy, xx or ik")
+	flag.StringVar(&encodedPsk, "psk", "", "base64 encoded 32-byte key shared by server and clients")
+
+	flag.StringVar(&identityFile, "identity", "", "key file with identity of the server or client (see keygen)")
+	flag.StringVar(&keyLogFile, "keylog", os.Getenv("HSPKEYLOGFILE"), "append session keys to the file for decoding captured traffic")
 
 	flag.Var(&headerList, "H", "provide additional header")
 
 	flag.Parse()
 
+	suites, err := ParseCipherSuites(ciphers)
+	if err != nil {
+		fmt.Println("ERR: Invalid cipher suites:", err)
+		return
+	}
+
+	handshake, err := ParseHandshake(handshakeName)
+	if err != nil {
+		fmt.Println("ERR: Invalid handshake:", err)
+		return
+	}
+
+	var psk *[32]byte
+	if len(encodedPsk) > 0 {
+		key, err := hsp.ParsePreSharedKey(encodedPsk)
+		if err != nil {
+			fmt.Println("ERR: Invalid pre-shared key:", err)
+			return
+		}
+		psk = &key
+	}
+
+	var identity *hsp.KeyPair
+	if len(identityFile) > 0 {
+		identity, err = hsp.LoadKeyPair(identityFile)
+		if err != nil {
+			fmt.Println("ERR: Failed to load identity:", err)
+			return
+		}
+	}
+
+	var keyLog io.Writer
+	if len(keyLogFile) > 0 {
+		file, err := os.OpenFile(keyLogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			fmt.Println("ERR: Failed to open key log:", err)
+			return
+		}
+		defer file.Close()
+
+		fmt.Printf("WARN: Session keys are written to %s\n", keyLogFile)
+		keyLog = file
+	}
+
 	if listening {
 		a := fmt.Sprintf("%s:%s", host, service)
 		addr, err := hsp.ParseAddress(a)
@@ -270,14 +407,30 @@ func main() {
 			return
 		}
 
-		StartServer(addr)
+		srv := server.NewServer(*addr)
+		srv.CipherSuites = suites
+		srv.PreSharedKey = psk
+		srv.Handshake = handshake
+		srv.KeyLog = keyLog
+		srv.Identity = identity
+
+		StartServer(srv)
 		return
 	}
 
 	options := &client.ClientOptions{
-		Headers: headerList.Map(),
-		Auth:    auth,
-		BaseURL: address,
+		Headers:          headerList.Map(),
+		Auth:             auth,
+		BaseURL:          address,
+		DisableKeepAlive: !keepAlive,
+		ServerKey:        serverKey,
+		KnownHostsFile:   knownHosts,
+		CipherSuites:     suites,
+		PreSharedKey:     psk,
+		Handshake:        handshake,
+		SessionCache:     hsp.NewMemorySessionCache(),
+		KeyLog:           keyLog,
+		Identity:         identity,
 	}
 
 	StartSession(options)
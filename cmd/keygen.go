@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/LandaMm/hsp-go/hsp"
+)
+
+// Keygen writes a new identity to the private key file and its public key
+// next to it with .pub extension
+func Keygen(args []string) {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+
+	var out string
+	var force bool
+	flags.StringVar(&out, "out", "hsp_identity", "path of the private key file")
+	flags.BoolVar(&force, "force", false, "replace existing key, e.g when rotating identity")
+
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s keygen [-out <file>] [-force]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	if !force {
+		if _, err := os.Stat(out); err == nil {
+			fmt.Printf("ERR: %s already exists, use -force to replace it\n", out)
+			return
+		} else if !errors.Is(err, os.ErrNotExist) {
+			fmt.Println("ERR: Failed to check key file:", err)
+			return
+		}
+	}
+
+	pair, err := hsp.GenerateKeyPair()
+	if err != nil {
+		fmt.Println("ERR: Failed to generate key pair:", err)
+		return
+	}
+
+	if err := hsp.SaveKeyPair(out, pair); err != nil {
+		fmt.Println("ERR: Failed to save private key:", err)
+		return
+	}
+
+	if err := hsp.SavePublicKey(out+".pub", pair.Public); err != nil {
+		fmt.Println("ERR: Failed to save public key:", err)
+		return
+	}
+
+	fmt.Printf("Private key saved to %s\n", out)
+	fmt.Printf("Public key saved to %s.pub\n", out)
+	fmt.Printf("Public key: %s\n", hsp.EncodePublicKey(pair.Public))
+	fmt.Printf("Fingerprint: %s\n", hsp.Fingerprint(pair.Public))
+}
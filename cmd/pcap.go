@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+)
+
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkLinuxSLL = 113
+)
+
+// TcpFlow is one direction of a TCP connection reassembled from capture
+type TcpFlow struct {
+	Src      string
+	Dst      string
+	First    int
+	segments []tcpSegment
+	base     uint32
+	synSeen  bool
+}
+
+type tcpSegment struct {
+	Seq  uint32
+	Data []byte
+}
+
+func (f *TcpFlow) Reverse() string {
+	return f.Dst + "->" + f.Src
+}
+
+// Data of the flow in order of sequence numbers, retransmitted segments are
+// dropped and gaps are left out
+func (f *TcpFlow) Data() []byte {
+	sort.SliceStable(f.segments, func(i, j int) bool {
+		return f.segments[i].Seq-f.base < f.segments[j].Seq-f.base
+	})
+
+	var out []byte
+	next := uint32(0)
+	for _, seg := range f.segments {
+		start := seg.Seq - f.base
+		end := start + uint32(len(seg.Data))
+		if end <= next {
+			continue
+		}
+		if start < next {
+			seg.Data = seg.Data[next-start:]
+		}
+		out = append(out, seg.Data...)
+		next = end
+	}
+	return out
+}
+
+func IsPcap(data []byte) bool {
+	if len(data) < 4 {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(data) {
+	case 0xa1b2c3d4, 0xd4c3b2a1, 0xa1b23c4d, 0x4d3cb2a1:
+		return true
+	}
+	return false
+}
+
+// ReadPcap reassembles TCP flows of a classic pcap capture, flows are
+// returned in order of their first packet
+func ReadPcap(data []byte) ([]*TcpFlow, error) {
+	if len(data) < 24 {
+		return nil, errors.New("pcap header is too short")
+	}
+
+	var order binary.ByteOrder
+	switch binary.LittleEndian.Uint32(data) {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("not a pcap file (pcapng is not supported)")
+	}
+
+	link := order.Uint32(data[20:24])
+
+	flows := make(map[string]*TcpFlow)
+	var ordered []*TcpFlow
+
+	offset := 24
+	for index := 0; offset+16 <= len(data); index++ {
+		size := int(order.Uint32(data[offset+8 : offset+12]))
+		offset += 16
+		if offset+size > len(data) {
+			return nil, fmt.Errorf("record %d is truncated", index)
+		}
+
+		frame := data[offset : offset+size]
+		offset += size
+
+		src, dst, seg, syn, ok := parseFrame(link, frame)
+		if !ok {
+			continue
+		}
+
+		key := src + "->" + dst
+		flow, found := flows[key]
+		if !found {
+			flow = &TcpFlow{Src: src, Dst: dst, First: index, base: seg.Seq}
+			flows[key] = flow
+			ordered = append(ordered, flow)
+		}
+
+		if syn {
+			// Data starts right after SYN, which takes one sequence number
+			seg.Seq++
+			flow.base = seg.Seq
+			flow.synSeen = true
+		} else if !flow.synSeen && seg.Seq-flow.base > 1<<31 {
+			flow.base = seg.Seq
+		}
+
+		if len(seg.Data) > 0 {
+			flow.segments = append(flow.segments, seg)
+		}
+	}
+
+	return ordered, nil
+}
+
+func parseFrame(link uint32, frame []byte) (src, dst string, seg tcpSegment, syn, ok bool) {
+	var packet []byte
+	var etherType uint16
+
+	switch link {
+	case linkEthernet:
+		if len(frame) < 14 {
+			return
+		}
+		etherType = binary.BigEndian.Uint16(frame[12:14])
+		packet = frame[14:]
+		// VLAN tag
+		if etherType == 0x8100 && len(packet) >= 4 {
+			etherType = binary.BigEndian.Uint16(packet[2:4])
+			packet = packet[4:]
+		}
+	case linkLinuxSLL:
+		if len(frame) < 16 {
+			return
+		}
+		etherType = binary.BigEndian.Uint16(frame[14:16])
+		packet = frame[16:]
+	case linkNull:
+		if len(frame) < 4 {
+			return
+		}
+		packet = frame[4:]
+	case linkRaw:
+		packet = frame
+	default:
+		return
+	}
+
+	if len(packet) == 0 {
+		return
+	}
+
+	var srcIP, dstIP net.IP
+	var segment []byte
+
+	switch {
+	case etherType == 0x0800 || (etherType == 0 && packet[0]>>4 == 4):
+		if len(packet) < 20 {
+			return
+		}
+		headerSize := int(packet[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(packet[2:4]))
+		if packet[9] != 6 || total > len(packet) || headerSize > total {
+			return
+		}
+		srcIP, dstIP = net.IP(packet[12:16]), net.IP(packet[16:20])
+		segment = packet[headerSize:total]
+	case etherType == 0x86dd || (etherType == 0 && packet[0]>>4 == 6):
+		if len(packet) < 40 {
+			return
+		}
+		total := 40 + int(binary.BigEndian.Uint16(packet[4:6]))
+		if packet[6] != 6 || total > len(packet) {
+			return
+		}
+		srcIP, dstIP = net.IP(packet[8:24]), net.IP(packet[24:40])
+		segment = packet[40:total]
+	default:
+		return
+	}
+
+	if len(segment) < 20 {
+		return
+	}
+
+	headerSize := int(segment[12]>>4) * 4
+	if headerSize > len(segment) {
+		return
+	}
+
+	srcPort := binary.BigEndian.Uint16(segment[0:2])
+	dstPort := binary.BigEndian.Uint16(segment[2:4])
+
+	src = net.JoinHostPort(srcIP.String(), fmt.Sprint(srcPort))
+	dst = net.JoinHostPort(dstIP.String(), fmt.Sprint(dstPort))
+	seg = tcpSegment{
+		Seq:  binary.BigEndian.Uint32(segment[4:8]),
+		Data: segment[headerSize:],
+	}
+	syn = segment[13]&0x02 != 0
+
+	return src, dst, seg, syn, true
+}
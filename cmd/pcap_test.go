@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// Builders of capture fixtures, every layer wraps the one below it
+
+func pcapFile(link uint32, frames ...[]byte) []byte {
+	out := binary.LittleEndian.AppendUint32(nil, 0xa1b2c3d4)
+	out = binary.LittleEndian.AppendUint16(out, 2)
+	out = binary.LittleEndian.AppendUint16(out, 4)
+	out = append(out, make([]byte, 8)...)
+	out = binary.LittleEndian.AppendUint32(out, 65535)
+	out = binary.LittleEndian.AppendUint32(out, link)
+
+	for i, frame := range frames {
+		out = binary.LittleEndian.AppendUint32(out, uint32(i))
+		out = binary.LittleEndian.AppendUint32(out, 0)
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(frame)))
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(frame)))
+		out = append(out, frame...)
+	}
+
+	return out
+}
+
+const (
+	tcpSyn = 0x02
+	tcpAck = 0x10
+)
+
+func tcpFrame(srcPort, dstPort uint16, seq uint32, flags byte, payload string) []byte {
+	out := binary.BigEndian.AppendUint16(nil, srcPort)
+	out = binary.BigEndian.AppendUint16(out, dstPort)
+	out = binary.BigEndian.AppendUint32(out, seq)
+	out = binary.BigEndian.AppendUint32(out, 0)
+	out = append(out, 5<<4, flags)
+	out = append(out, make([]byte, 6)...)
+	return append(out, payload...)
+}
+
+func ipv4Frame(src, dst string, segment []byte) []byte {
+	out := []byte{0x45, 0}
+	out = binary.BigEndian.AppendUint16(out, uint16(20+len(segment)))
+	out = append(out, 0, 0, 0, 0, 64, 6, 0, 0)
+	out = append(out, net.ParseIP(src).To4()...)
+	out = append(out, net.ParseIP(dst).To4()...)
+	return append(out, segment...)
+}
+
+func ipv6Frame(src, dst string, segment []byte) []byte {
+	out := []byte{0x60, 0, 0, 0}
+	out = binary.BigEndian.AppendUint16(out, uint16(len(segment)))
+	out = append(out, 6, 64)
+	out = append(out, net.ParseIP(src).To16()...)
+	out = append(out, net.ParseIP(dst).To16()...)
+	return append(out, segment...)
+}
+
+func ethernetFrame(etherType uint16, packet []byte) []byte {
+	out := make([]byte, 12)
+	out = binary.BigEndian.AppendUint16(out, etherType)
+	return append(out, packet...)
+}
+
+func vlanFrame(etherType uint16, packet []byte) []byte {
+	out := make([]byte, 12)
+	out = binary.BigEndian.AppendUint16(out, 0x8100)
+	out = append(out, 0, 42)
+	out = binary.BigEndian.AppendUint16(out, etherType)
+	return append(out, packet...)
+}
+
+func sllFrame(etherType uint16, packet []byte) []byte {
+	out := make([]byte, 14)
+	out = binary.BigEndian.AppendUint16(out, etherType)
+	return append(out, packet...)
+}
+
+func TestReadPcapReassemblesFlows(t *testing.T) {
+	client, server := "10.0.0.1", "10.0.0.2"
+
+	segment := func(seq uint32, flags byte, payload string) []byte {
+		return ethernetFrame(0x0800, ipv4Frame(client, server, tcpFrame(5000, 998, seq, flags, payload)))
+	}
+	reply := func(seq uint32, payload string) []byte {
+		return ethernetFrame(0x0800, ipv4Frame(server, client, tcpFrame(998, 5000, seq, tcpAck, payload)))
+	}
+
+	data := pcapFile(linkEthernet,
+		segment(1000, tcpSyn, ""),
+		segment(1007, tcpAck, "world"),
+		reply(7000, "hi"),
+		segment(1001, tcpAck, "hello "),
+		// Retransmissions, whole and partial
+		segment(1001, tcpAck, "hello "),
+		segment(1004, tcpAck, "lo wor"),
+		segment(1012, tcpAck, "!"),
+	)
+
+	flows, err := ReadPcap(data)
+	if err != nil {
+		t.Fatal("ERR: Failed to read capture:", err)
+	}
+
+	if len(flows) != 2 {
+		t.Fatalf("Expected 2 flows, got %d", len(flows))
+	}
+
+	if flows[0].Src != "10.0.0.1:5000" || flows[0].Dst != "10.0.0.2:998" || flows[0].Reverse() != "10.0.0.2:998->10.0.0.1:5000" {
+		t.Errorf("Unexpected client flow: %s -> %s", flows[0].Src, flows[0].Dst)
+	}
+
+	if data := string(flows[0].Data()); data != "hello world!" {
+		t.Errorf("Unexpected client data: %q", data)
+	}
+
+	// Flow without SYN starts at its first segment
+	if data := string(flows[1].Data()); data != "hi" {
+		t.Errorf("Unexpected server data: %q", data)
+	}
+}
+
+func TestReadPcapLeavesOutGaps(t *testing.T) {
+	segment := func(seq uint32, payload string) []byte {
+		return ipv4Frame("10.0.0.1", "10.0.0.2", tcpFrame(5000, 998, seq, tcpAck, payload))
+	}
+
+	flows, err := ReadPcap(pcapFile(linkRaw, segment(100, "abc"), segment(109, "xyz")))
+	if err != nil {
+		t.Fatal("ERR: Failed to read capture:", err)
+	}
+
+	if len(flows) != 1 {
+		t.Fatalf("Expected 1 flow, got %d", len(flows))
+	}
+
+	if data := string(flows[0].Data()); data != "abcxyz" {
+		t.Errorf("Unexpected data: %q", data)
+	}
+}
+
+func TestReadPcapLinkTypes(t *testing.T) {
+	v4 := ipv4Frame("192.168.1.1", "192.168.1.2", tcpFrame(5000, 998, 1, tcpAck, "data"))
+	v6 := ipv6Frame("2001:db8::1", "2001:db8::2", tcpFrame(5000, 998, 1, tcpAck, "data"))
+
+	for _, tc := range []struct {
+		name  string
+		link  uint32
+		frame []byte
+		src   string
+	}{
+		{"ethernet", linkEthernet, ethernetFrame(0x0800, v4), "192.168.1.1:5000"},
+		{"vlan", linkEthernet, vlanFrame(0x0800, v4), "192.168.1.1:5000"},
+		{"sll", linkLinuxSLL, sllFrame(0x0800, v4), "192.168.1.1:5000"},
+		{"null", linkNull, append([]byte{2, 0, 0, 0}, v4...), "192.168.1.1:5000"},
+		{"ipv6", linkEthernet, ethernetFrame(0x86dd, v6), "[2001:db8::1]:5000"},
+		{"vlan ipv6", linkEthernet, vlanFrame(0x86dd, v6), "[2001:db8::1]:5000"},
+		{"raw ipv6", linkRaw, v6, "[2001:db8::1]:5000"},
+	} {
+		flows, err := ReadPcap(pcapFile(tc.link, tc.frame))
+		if err != nil {
+			t.Fatalf("ERR: Failed to read %s capture: %v", tc.name, err)
+		}
+
+		if len(flows) != 1 {
+			t.Fatalf("Expected 1 flow in %s capture, got %d", tc.name, len(flows))
+		}
+
+		if flows[0].Src != tc.src || string(flows[0].Data()) != "data" {
+			t.Errorf("Unexpected %s flow from %s: %q", tc.name, flows[0].Src, flows[0].Data())
+		}
+	}
+}
+
+func TestReadPcapInvalid(t *testing.T) {
+	if IsPcap([]byte("not a capture")) {
+		t.Error("Text was recognized as pcap")
+	}
+
+	data := pcapFile(linkRaw, ipv4Frame("10.0.0.1", "10.0.0.2", tcpFrame(1, 2, 1, tcpAck, "data")))
+	if !IsPcap(data) {
+		t.Error("Capture wasn't recognized as pcap")
+	}
+
+	if _, err := ReadPcap(data[:len(data)-1]); err == nil {
+		t.Error("Truncated capture was accepted")
+	}
+
+	// Frames of other protocols are skipped
+	udp := ipv4Frame("10.0.0.1", "10.0.0.2", tcpFrame(1, 2, 1, tcpAck, "data"))
+	udp[9] = 17
+
+	flows, err := ReadPcap(pcapFile(linkRaw, udp))
+	if err != nil || len(flows) != 0 {
+		t.Errorf("Expected UDP frame to be skipped, got %d flows: %v", len(flows), err)
+	}
+}
@@ -3,7 +3,8 @@ module github.com/LandaMm/hsp-go
 go 1.24.1
 
 require (
-	github.com/chzyer/readline v1.5.1 // indirect
-	golang.org/x/crypto v0.37.0 // indirect
-	golang.org/x/sys v0.32.0 // indirect
+	github.com/chzyer/readline v1.5.1
+	golang.org/x/crypto v0.37.0
 )
+
+require golang.org/x/sys v0.32.0 // indirect
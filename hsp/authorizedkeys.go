@@ -0,0 +1,66 @@
+package hsp
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// AuthorizedKeys is an allow-list of client identity keys. Each line of the
+// file contains encoded key optionally followed by a comment, lines
+// starting with # are ignored.
+type AuthorizedKeys struct {
+	keys map[[32]byte]string
+}
+
+func LoadAuthorizedKeys(path string) (*AuthorizedKeys, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	authorized := &AuthorizedKeys{
+		keys: make(map[[32]byte]string),
+	}
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		// Key and comment may be separated with any whitespace, spaces
+		// within the comment are kept
+		encoded := strings.Fields(text)[0]
+		comment := strings.TrimSpace(text[len(encoded):])
+
+		key, err := ParsePublicKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err.Error())
+		}
+
+		authorized.keys[key] = comment
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return authorized, nil
+}
+
+func (a *AuthorizedKeys) Contains(key [32]byte) bool {
+	_, ok := a.keys[key]
+	return ok
+}
+
+// Comment returns the comment written next to the key, usually the name of
+// its owner
+func (a *AuthorizedKeys) Comment(key [32]byte) (string, bool) {
+	comment, ok := a.keys[key]
+	return comment, ok
+}
@@ -0,0 +1,58 @@
+package hsp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadAuthorizedKeys(t *testing.T) {
+	alice, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate key:", err)
+	}
+
+	bob, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate key:", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	data := "# clients\n\n" +
+		EncodePublicKey(alice.Public) + "\talice  laptop\n" +
+		"  " + EncodePublicKey(bob.Public) + "\n"
+
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal("ERR: Failed to write keys:", err)
+	}
+
+	keys, err := LoadAuthorizedKeys(path)
+	if err != nil {
+		t.Fatal("ERR: Failed to load keys:", err)
+	}
+
+	if comment, ok := keys.Comment(alice.Public); !ok || comment != "alice  laptop" {
+		t.Errorf("Unexpected comment of tab-separated key: %q", comment)
+	}
+
+	if comment, ok := keys.Comment(bob.Public); !ok || comment != "" {
+		t.Errorf("Unexpected comment of key without one: %q", comment)
+	}
+
+	if keys.Contains([32]byte{}) {
+		t.Error("Unknown key is authorized")
+	}
+}
+
+func TestLoadAuthorizedKeysInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	if err := os.WriteFile(path, []byte("# clients\nnot-a-key comment\n"), 0600); err != nil {
+		t.Fatal("ERR: Failed to write keys:", err)
+	}
+
+	_, err := LoadAuthorizedKeys(path)
+	if err == nil || !strings.HasPrefix(err.Error(), path+":2:") {
+		t.Error("Expected error pointing at the line, got:", err)
+	}
+}
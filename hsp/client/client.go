@@ -2,25 +2,69 @@ package client
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-
-	"maps"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/LandaMm/hsp-go/hsp"
 )
 
 type ClientOptions struct {
-	Headers map[string]string
+	Headers hsp.Header
 	// TODO: in future support multiple types of auth (credentials, key etc.)
 	Auth    string
 	BaseURL string
+	// Size of portions used for sending streams, defaults to hsp.DefaultStreamBufferSize
+	StreamBufferSize int
+	// Close connection after every request, by default connections are
+	// kept for following requests to the same address
+	DisableKeepAlive bool
+	// Maximum amount of idle connections kept per address
+	MaxIdleConns int
+	// Maximum amount of connections per address, 0 means unlimited
+	MaxConnsPerHost int
+	// How long idle connection is kept in the pool
+	IdleConnTimeout time.Duration
+	// Pipeline concurrent requests over a single connection per address
+	Multiplex bool
+	// Encoded identity key of the server, connections to servers with
+	// other keys are refused
+	ServerKey string
+	// File of remembered server identity keys, unknown servers are trusted
+	// on first use
+	KnownHostsFile string
+	// Cipher suites offered to the server, hsp.DefaultCipherSuites if empty
+	CipherSuites []hsp.CipherSuite
+	// Long-term key proving client's identity to the server, anonymous if nil
+	Identity *hsp.KeyPair
+	// Key exchange used for new connections, hsp.LegacyHandshake if nil
+	Handshake hsp.Handshake
+	// Secret shared with the server, mixed into the session keys
+	PreSharedKey *[32]byte
+	// Remembers session tickets, so following connections to the same
+	// address skip the key exchange. Tickets are not used if nil
+	SessionCache hsp.ClientSessionCache
+	// Keys of every connection are appended to it, so captured traffic can
+	// be decrypted. Meant only for debugging
+	KeyLog io.Writer
+	// Content encodings accepted in responses in order of preference,
+	// hsp.SupportedEncodings() if empty
+	AcceptEncoding []string
+	// Don't ask the server to compress responses
+	DisableCompression bool
 }
 
 type Client struct {
 	Options *ClientOptions
 	Base    *hsp.Adddress
+	pool    *pool
+	muxes   map[string]*muxConn
+	muxMu   sync.Mutex
+	// Shared between connections so concurrent handshakes don't race on the file
+	knownHosts *hsp.KnownHosts
 }
 
 func NewClient(options *ClientOptions) *Client {
@@ -37,63 +81,221 @@ func NewClient(options *ClientOptions) *Client {
 		}
 	}
 
+	maxIdle := options.MaxIdleConns
+	if maxIdle <= 0 {
+		maxIdle = DefaultMaxIdleConns
+	}
+
+	idleTimeout := options.IdleConnTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultIdleConnTimeout
+	}
+
 	return &Client{
-		Options: options,
-		Base:    base,
+		Options:    options,
+		Base:       base,
+		pool:       newPool(maxIdle, options.MaxConnsPerHost, idleTimeout),
+		muxes:      make(map[string]*muxConn),
+		knownHosts: hsp.NewKnownHosts(options.KnownHostsFile),
 	}
 }
 
-func (c *Client) BuildHeaders(address *hsp.Adddress, df *hsp.DataFormat) map[string]string {
-	headers := make(map[string]string)
+func (c *Client) BuildHeaders(address *hsp.Adddress, df *hsp.DataFormat) hsp.Header {
+	headers := make(hsp.Header)
 
-	if len(c.Options.Headers) > 0 {
-		maps.Copy(headers, c.Options.Headers)
+	// Options could be filled as a literal, so keys are canonicalized here
+	for key, values := range c.Options.Headers {
+		for _, value := range values {
+			headers.Add(key, value)
+		}
 	}
 
-	headers[hsp.H_ROUTE] = address.Route
-	headers[hsp.H_DATA_FORMAT] = df.String()
+	headers.Set(hsp.H_ROUTE, address.Route)
+	headers.Set(hsp.H_DATA_FORMAT, df.String())
 
 	if len(c.Options.Auth) > 0 {
-		headers[hsp.H_AUTH] = c.Options.Auth
+		headers.Set(hsp.H_AUTH, c.Options.Auth)
+	}
+
+	if !c.Options.DisableCompression && !headers.Has(hsp.H_ACCEPT_ENCODING) {
+		encodings := c.Options.AcceptEncoding
+		if len(encodings) == 0 {
+			encodings = hsp.SupportedEncodings()
+		}
+
+		for _, encoding := range encodings {
+			headers.Add(hsp.H_ACCEPT_ENCODING, encoding)
+		}
 	}
 
 	return headers
 }
 
-func (c *Client) SingleHit(addr *hsp.Adddress, pkt *hsp.Packet) (*hsp.Packet, error) {
+func (c *Client) resolve(address string) (*hsp.Adddress, error) {
+	if c.Base != nil {
+		return c.Base.Extend(address)
+	}
+	return hsp.ParseAddress(address)
+}
+
+func (c *Client) dial(addr *hsp.Adddress) (*hsp.Connection, error) {
 	rawConn, err := net.Dial("tcp", addr.String())
 	if err != nil {
 		return nil, err
 	}
 
-	defer rawConn.Close()
+	config := &hsp.ClientConfig{
+		Host:         addr.String(),
+		CipherSuites: c.Options.CipherSuites,
+		Identity:     c.Options.Identity,
+		PreSharedKey: c.Options.PreSharedKey,
+		SessionCache: c.Options.SessionCache,
+	}
+
+	if len(c.Options.ServerKey) > 0 {
+		key, err := hsp.ParsePublicKey(c.Options.ServerKey)
+		if err != nil {
+			rawConn.Close()
+			return nil, fmt.Errorf("invalid server key: %s", err.Error())
+		}
+		config.PinnedKey = &key
+	}
 
-	keys, err := hsp.GenerateKeyPair()
+	if len(c.Options.KnownHostsFile) > 0 {
+		config.KnownHosts = c.knownHosts
+	}
+
+	handshake := c.Options.Handshake
+	if handshake == nil {
+		handshake = hsp.LegacyHandshake
+	}
+
+	conn, err := handshake.Client(rawConn, config)
 	if err != nil {
+		rawConn.Close()
 		return nil, err
 	}
 
-	n, err := rawConn.Write(keys.Public[:])
+	if c.Options.KeyLog != nil {
+		if err := conn.LogKeys(c.Options.KeyLog); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("couldn't log keys: %w", err)
+		}
+	}
+
+	return conn, nil
+}
+
+func (c *Client) SingleHit(addr *hsp.Adddress, pkt *hsp.Packet) (*hsp.Packet, error) {
+	if c.Options.Multiplex {
+		return c.multiplexedHit(addr, pkt)
+	}
+
+	if !c.Options.DisableKeepAlive {
+		return c.keepAliveHit(addr, pkt)
+	}
+
+	conn, err := c.dial(addr)
 	if err != nil {
 		return nil, err
 	}
 
-	if n != 32 {
-		return nil, fmt.Errorf("failed to send 32 bytes of key (%d sent instead)", n)
+	defer conn.Close()
+
+	return exchange(conn, pkt)
+}
+
+func (c *Client) keepAliveHit(addr *hsp.Adddress, pkt *hsp.Packet) (*hsp.Packet, error) {
+	key := addr.String()
+
+	pkt.SetFlag(hsp.F_KEEP_ALIVE)
+
+	for {
+		conn, err := c.pool.get(key)
+		if err != nil {
+			return nil, err
+		}
+
+		reused := conn != nil
+		if !reused {
+			conn, err = c.dial(addr)
+			if err != nil {
+				c.pool.release(key, nil)
+				return nil, err
+			}
+		}
+
+		n, err := conn.Write(pkt)
+		if err != nil {
+			c.pool.release(key, conn)
+
+			// Server might have closed the idle connection in the meantime,
+			// request is sent again only if none of it was written
+			if reused && n == 0 {
+				continue
+			}
+			return nil, err
+		}
+
+		// Server may have already handled the request, so it isn't repeated
+		rpkt, err := conn.Read()
+		if err != nil {
+			c.pool.release(key, conn)
+			return nil, err
+		}
+
+		// Packets which are still to come would be read as a response to
+		// the next request
+		if rpkt.KeepAlive() && rpkt.EndStream() {
+			c.pool.put(key, conn)
+		} else {
+			c.pool.release(key, conn)
+		}
+		return rpkt, nil
+	}
+}
+
+func (c *Client) multiplexedHit(addr *hsp.Adddress, pkt *hsp.Packet) (*hsp.Packet, error) {
+	for {
+		m, fresh, err := c.muxFor(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		rpkt, err := m.roundTrip(pkt)
+
+		// Server might have closed the idle connection in the meantime,
+		// errMuxClosed means the request wasn't sent
+		if errors.Is(err, errMuxClosed) && !fresh {
+			continue
+		}
+
+		return rpkt, err
 	}
+}
 
-	serverKey := make([]byte, 32)
-	if _, err := io.ReadFull(rawConn, serverKey); err != nil {
-		return nil, err
+func (c *Client) muxFor(addr *hsp.Adddress) (*muxConn, bool, error) {
+	key := addr.String()
+
+	c.muxMu.Lock()
+	defer c.muxMu.Unlock()
+
+	if m, ok := c.muxes[key]; ok && m.alive() {
+		return m, false, nil
 	}
 
-	sharedKey, err := hsp.DeriveSharedKey(keys.Private, [32]byte(serverKey))
+	conn, err := c.dial(addr)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	conn := hsp.NewConnection(rawConn, keys, sharedKey)
+	m := newMuxConn(conn)
+	c.muxes[key] = m
+
+	return m, true, nil
+}
 
+func exchange(conn *hsp.Connection, pkt *hsp.Packet) (*hsp.Packet, error) {
 	if _, err := conn.Write(pkt); err != nil {
 		return nil, err
 	}
@@ -101,16 +303,22 @@ func (c *Client) SingleHit(addr *hsp.Adddress, pkt *hsp.Packet) (*hsp.Packet, er
 	return conn.Read()
 }
 
-func (c *Client) SendText(address, text string) (*hsp.Response, error) {
-	var addr *hsp.Adddress
-	var err error
+func (c *Client) Close() error {
+	c.pool.close()
 
-	if c.Base != nil {
-		addr, err = c.Base.Extend(address)
-	} else {
-		addr, err = hsp.ParseAddress(address)
+	c.muxMu.Lock()
+	defer c.muxMu.Unlock()
+
+	for key, m := range c.muxes {
+		m.close()
+		delete(c.muxes, key)
 	}
 
+	return nil
+}
+
+func (c *Client) SendText(address, text string) (*hsp.Response, error) {
+	addr, err := c.resolve(address)
 	if err != nil {
 		return nil, err
 	}
@@ -130,15 +338,7 @@ func (c *Client) SendText(address, text string) (*hsp.Response, error) {
 }
 
 func (c *Client) SendJson(address string, data any) (*hsp.Response, error) {
-	var addr *hsp.Adddress
-	var err error
-
-	if c.Base != nil {
-		addr, err = c.Base.Extend(address)
-	} else {
-		addr, err = hsp.ParseAddress(address)
-	}
-
+	addr, err := c.resolve(address)
 	if err != nil {
 		return nil, err
 	}
@@ -161,15 +361,7 @@ func (c *Client) SendJson(address string, data any) (*hsp.Response, error) {
 }
 
 func (c *Client) SendBytes(address string, data []byte) (*hsp.Response, error) {
-	var addr *hsp.Adddress
-	var err error
-
-	if c.Base != nil {
-		addr, err = c.Base.Extend(address)
-	} else {
-		addr, err = hsp.ParseAddress(address)
-	}
-
+	addr, err := c.resolve(address)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,169 @@
+package client
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/LandaMm/hsp-go/hsp"
+)
+
+// startServer answers requests with their route until dropAfter requests in
+// total have been received, following requests are dropped with the
+// connection before answering them. Response to /partial claims that more
+// packets follow.
+func startServer(t *testing.T, dropAfter int32) (string, *atomic.Int32) {
+	t.Helper()
+
+	identity, err := hsp.GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate identity:", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("ERR: Failed to listen:", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	received := &atomic.Int32{}
+
+	go func() {
+		for {
+			rawConn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				conn, err := hsp.LegacyHandshake.Server(rawConn, &hsp.ServerConfig{Identity: identity})
+				if err != nil {
+					rawConn.Close()
+					return
+				}
+				defer conn.Close()
+
+				for {
+					pkt, err := conn.Read()
+					if err != nil {
+						return
+					}
+
+					if received.Add(1) > dropAfter {
+						return
+					}
+
+					res := hsp.NewTextResponse(pkt.Headers.Get(hsp.H_ROUTE)).ToPacket()
+					res.RequestID = pkt.RequestID
+					res.SetFlag(hsp.F_KEEP_ALIVE)
+					if pkt.Headers.Get(hsp.H_ROUTE) != "/partial" {
+						res.SetFlag(hsp.F_END_STREAM)
+					}
+
+					if _, err := conn.Write(res); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return ln.Addr().String(), received
+}
+
+func TestClientReusesConnections(t *testing.T) {
+	addr, _ := startServer(t, 100)
+
+	c := NewClient(&ClientOptions{BaseURL: addr})
+	defer c.Close()
+
+	for range 3 {
+		if _, err := c.SendText("/ping", ""); err != nil {
+			t.Fatal("ERR: Failed to send request:", err)
+		}
+	}
+
+	if total := c.pool.host(c.Base.String()).total; total != 1 {
+		t.Errorf("Expected a single pooled connection, got %d", total)
+	}
+
+	// Rest of the response would be mistaken for response to the next request
+	if _, err := c.SendText("/partial", ""); err != nil {
+		t.Fatal("ERR: Failed to send request:", err)
+	}
+
+	if total := c.pool.host(c.Base.String()).total; total != 0 {
+		t.Errorf("Connection with unfinished response was kept: %d", total)
+	}
+}
+
+func TestClientRetriesUnsentRequests(t *testing.T) {
+	addr, received := startServer(t, 100)
+
+	for _, options := range []*ClientOptions{
+		{BaseURL: addr},
+		{BaseURL: addr, Multiplex: true},
+	} {
+		c := NewClient(options)
+
+		if _, err := c.SendText("/first", ""); err != nil {
+			t.Fatal("ERR: Failed to send request:", err)
+		}
+
+		// Connection breaks while idle, nothing of the next request is sent
+		if options.Multiplex {
+			for _, m := range c.muxes {
+				m.conn.Close()
+			}
+		} else {
+			for _, h := range c.pool.hosts {
+				for _, ic := range h.idle {
+					ic.conn.Close()
+				}
+			}
+		}
+
+		res, err := c.SendText("/second", "")
+		if err != nil {
+			t.Fatal("ERR: Unsent request wasn't retried:", err)
+		}
+
+		if string(res.Payload) != "/second" {
+			t.Errorf("Unexpected response: %s", string(res.Payload))
+		}
+
+		c.Close()
+	}
+
+	if n := received.Load(); n != 4 {
+		t.Errorf("Expected 4 requests to reach the server, got %d", n)
+	}
+}
+
+func TestClientDoesNotRepeatSentRequests(t *testing.T) {
+	for _, options := range []*ClientOptions{
+		{},
+		{Multiplex: true},
+	} {
+		addr, received := startServer(t, 1)
+		options.BaseURL = addr
+
+		c := NewClient(options)
+
+		if _, err := c.SendText("/first", ""); err != nil {
+			t.Fatal("ERR: Failed to send request:", err)
+		}
+
+		// Server receives the request and drops the connection, it might
+		// have handled it already
+		if _, err := c.SendText("/second", ""); err == nil {
+			t.Error("Request without response succeeded")
+		}
+
+		if n := received.Load(); n != 2 {
+			t.Errorf("Expected request to reach the server once, got %d requests", n)
+		}
+
+		c.Close()
+	}
+}
@@ -0,0 +1,117 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/LandaMm/hsp-go/hsp"
+)
+
+// Request wasn't sent because the connection is closed, so it is safe to
+// send it again over another one
+var errMuxClosed = errors.New("multiplexed connection is closed")
+
+type muxResult struct {
+	packet *hsp.Packet
+	err    error
+}
+
+// muxConn pipelines concurrent requests over a single connection and
+// dispatches responses by their request id
+type muxConn struct {
+	conn    *hsp.Connection
+	pending map[uint32]chan muxResult
+	nextID  uint32
+	err     error
+	mu      sync.Mutex
+}
+
+func newMuxConn(conn *hsp.Connection) *muxConn {
+	m := &muxConn{
+		conn:    conn,
+		pending: make(map[uint32]chan muxResult),
+	}
+
+	go m.readLoop()
+
+	return m
+}
+
+func (m *muxConn) roundTrip(pkt *hsp.Packet) (*hsp.Packet, error) {
+	m.mu.Lock()
+	if m.err != nil {
+		err := m.err
+		m.mu.Unlock()
+		return nil, fmt.Errorf("%w: %w", errMuxClosed, err)
+	}
+
+	m.nextID++
+	if m.nextID == 0 {
+		m.nextID++
+	}
+
+	id := m.nextID
+	ch := make(chan muxResult, 1)
+	m.pending[id] = ch
+	m.mu.Unlock()
+
+	pkt.RequestID = id
+	pkt.SetFlag(hsp.F_KEEP_ALIVE)
+
+	if n, err := m.conn.Write(pkt); err != nil {
+		m.fail(err)
+		if n == 0 {
+			return nil, fmt.Errorf("%w: %w", errMuxClosed, err)
+		}
+	}
+
+	res := <-ch
+	return res.packet, res.err
+}
+
+func (m *muxConn) readLoop() {
+	for {
+		pkt, err := m.conn.Read()
+		if err != nil {
+			m.fail(err)
+			return
+		}
+
+		m.mu.Lock()
+		ch, ok := m.pending[pkt.RequestID]
+		delete(m.pending, pkt.RequestID)
+		m.mu.Unlock()
+
+		if ok {
+			ch <- muxResult{packet: pkt}
+		}
+	}
+}
+
+func (m *muxConn) fail(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err == nil {
+		m.err = err
+		m.conn.Close()
+	}
+
+	for id, ch := range m.pending {
+		ch <- muxResult{err: err}
+		delete(m.pending, id)
+	}
+}
+
+func (m *muxConn) alive() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err == nil
+}
+
+// close interrupts pending requests, which might have reached the server
+func (m *muxConn) close() {
+	m.fail(net.ErrClosed)
+}
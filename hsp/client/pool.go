@@ -0,0 +1,148 @@
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/LandaMm/hsp-go/hsp"
+)
+
+const (
+	DefaultMaxIdleConns    = 2
+	DefaultIdleConnTimeout = 30 * time.Second
+)
+
+var ErrClientClosed = errors.New("client is closed")
+
+type idleConn struct {
+	conn  *hsp.Connection
+	since time.Time
+}
+
+type hostPool struct {
+	idle []idleConn
+	// Amount of established connections, both idle and borrowed
+	total int
+}
+
+type pool struct {
+	hosts       map[string]*hostPool
+	maxIdle     int
+	maxPerHost  int
+	idleTimeout time.Duration
+	closed      bool
+	mu          sync.Mutex
+	cond        *sync.Cond
+}
+
+func newPool(maxIdle, maxPerHost int, idleTimeout time.Duration) *pool {
+	p := &pool{
+		hosts:       make(map[string]*hostPool),
+		maxIdle:     maxIdle,
+		maxPerHost:  maxPerHost,
+		idleTimeout: idleTimeout,
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+func (p *pool) host(key string) *hostPool {
+	h, ok := p.hosts[key]
+	if !ok {
+		h = &hostPool{}
+		p.hosts[key] = h
+	}
+	return h
+}
+
+// get returns idle connection for the address if there is one, otherwise
+// reserves a slot for a new connection that caller has to dial, returning nil
+func (p *pool) get(key string) (*hsp.Connection, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		if p.closed {
+			return nil, ErrClientClosed
+		}
+
+		h := p.host(key)
+		p.evictExpired(h)
+
+		if n := len(h.idle); n > 0 {
+			ic := h.idle[n-1]
+			h.idle = h.idle[:n-1]
+			return ic.conn, nil
+		}
+
+		if p.maxPerHost <= 0 || h.total < p.maxPerHost {
+			h.total++
+			return nil, nil
+		}
+
+		p.cond.Wait()
+	}
+}
+
+func (p *pool) evictExpired(h *hostPool) {
+	if p.idleTimeout <= 0 {
+		return
+	}
+
+	fresh := h.idle[:0]
+	for _, ic := range h.idle {
+		if time.Since(ic.since) > p.idleTimeout {
+			ic.conn.Close()
+			h.total--
+		} else {
+			fresh = append(fresh, ic)
+		}
+	}
+	h.idle = fresh
+}
+
+func (p *pool) put(key string, conn *hsp.Connection) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h := p.host(key)
+
+	if p.closed || len(h.idle) >= p.maxIdle {
+		conn.Close()
+		h.total--
+	} else {
+		h.idle = append(h.idle, idleConn{conn: conn, since: time.Now()})
+	}
+
+	p.cond.Broadcast()
+}
+
+// release frees the slot of connection that is broken or failed to dial
+func (p *pool) release(key string, conn *hsp.Connection) {
+	if conn != nil {
+		conn.Close()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.host(key).total--
+	p.cond.Broadcast()
+}
+
+func (p *pool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for _, h := range p.hosts {
+		for _, ic := range h.idle {
+			ic.conn.Close()
+			h.total--
+		}
+		h.idle = nil
+	}
+
+	p.cond.Broadcast()
+}
@@ -0,0 +1,138 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/LandaMm/hsp-go/hsp"
+)
+
+// StreamError is returned when stream was interrupted after server has
+// assigned a key to it, the key can be used to resume the stream later
+type StreamError struct {
+	Key string
+	Err error
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("stream '%s' interrupted: %s", e.Key, e.Err.Error())
+}
+
+func (e *StreamError) Unwrap() error {
+	return e.Err
+}
+
+func (c *Client) SendStream(address string, r io.Reader, size int64) (*hsp.Response, error) {
+	return c.stream(address, "", r, size)
+}
+
+// ResumeStream continues the stream identified by key. Reader must be
+// positioned at the beginning of the stream data, the part that server has
+// already received is skipped.
+func (c *Client) ResumeStream(address, key string, r io.Reader) (*hsp.Response, error) {
+	return c.stream(address, key, r, 0)
+}
+
+func (c *Client) stream(address, key string, r io.Reader, size int64) (*hsp.Response, error) {
+	addr, err := c.resolve(address)
+	if err != nil {
+		return nil, err
+	}
+
+	bufferSize := c.Options.StreamBufferSize
+	if bufferSize <= 0 {
+		bufferSize = hsp.DefaultStreamBufferSize
+	}
+
+	hdrs := c.BuildHeaders(addr, hsp.BytesDataFormat())
+	hdrs.Set(hsp.H_STREAM, hsp.FormatStreamHeader(size, int64(bufferSize)))
+	if len(key) > 0 {
+		hdrs.Set(hsp.H_STREAM_KEY, key)
+	}
+
+	conn, err := c.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	if _, err := conn.Write(hsp.BuildPacket(hdrs, nil)); err != nil {
+		return nil, err
+	}
+
+	ack, err := conn.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	accepted, serverBufferSize, err := hsp.ParseStreamHeader(ack.Headers.Get(hsp.H_STREAM))
+	if err != nil {
+		return nil, err
+	}
+
+	// Refusal is the whole response, acknowledgment is followed by the final one
+	if accepted < 0 || ack.EndStream() {
+		return nil, fmt.Errorf("server refused the stream with status %s", ack.Headers.Get(hsp.H_STATUS))
+	}
+
+	key = ack.Headers.Get(hsp.H_STREAM_KEY)
+
+	if ack.Headers.Has(hsp.H_STREAM_OFFSET) {
+		n, err := strconv.ParseInt(ack.Headers.Get(hsp.H_STREAM_OFFSET), 10, 64)
+		if err != nil {
+			return nil, &StreamError{Key: key, Err: err}
+		}
+
+		if err := skip(r, n); err != nil {
+			return nil, &StreamError{Key: key, Err: err}
+		}
+	} else if accepted == 0 {
+		accepted = size
+	}
+
+	if serverBufferSize > 0 {
+		bufferSize = int(serverBufferSize)
+	}
+
+	buf := make([]byte, bufferSize)
+
+	for remaining := accepted; remaining > 0; {
+		portion := buf
+		if int64(len(portion)) > remaining {
+			portion = portion[:remaining]
+		}
+
+		if _, err := io.ReadFull(r, portion); err != nil {
+			return nil, &StreamError{Key: key, Err: fmt.Errorf("failed to read stream data: %s", err.Error())}
+		}
+
+		if _, werr := conn.Write(hsp.BuildPacket(hsp.Header{}, portion)); werr != nil {
+			// Server might have already sent the final packet explaining the failure
+			if final, err := conn.Read(); err == nil {
+				return hsp.NewPacketResponse(final), nil
+			}
+			return nil, &StreamError{Key: key, Err: werr}
+		}
+
+		remaining -= int64(len(portion))
+	}
+
+	final, err := conn.Read()
+	if err != nil {
+		return nil, &StreamError{Key: key, Err: err}
+	}
+
+	return hsp.NewPacketResponse(final), nil
+}
+
+func skip(r io.Reader, n int64) error {
+	if seeker, ok := r.(io.Seeker); ok {
+		_, err := seeker.Seek(n, io.SeekCurrent)
+		return err
+	}
+
+	_, err := io.CopyN(io.Discard, r, n)
+	return err
+}
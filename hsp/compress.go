@@ -0,0 +1,154 @@
+package hsp
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+const (
+	CE_GZIP    = "gzip"
+	CE_DEFLATE = "deflate"
+)
+
+// Decompressed payloads larger than this are refused, so small packets
+// can't be inflated into huge allocations
+const DefaultMaxDecompressedSize = 1 << 28
+
+var ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// Compressor implements one content encoding of packet payloads
+type Compressor interface {
+	Compress(w io.Writer) (io.WriteCloser, error)
+	Decompress(r io.Reader) (io.Reader, error)
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+type deflateCompressor struct{}
+
+func (deflateCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, flate.DefaultCompression)
+}
+
+func (deflateCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	return flate.NewReader(r), nil
+}
+
+var (
+	compressors = map[string]Compressor{
+		CE_GZIP:    gzipCompressor{},
+		CE_DEFLATE: deflateCompressor{},
+	}
+	// Encodings in order of preference, used when client doesn't list any
+	compressorOrder = []string{CE_GZIP, CE_DEFLATE}
+	compressorsMu   sync.RWMutex
+)
+
+// RegisterCompressor adds content encoding, registering already known name
+// replaces its compressor
+func RegisterCompressor(name string, c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+
+	name = strings.ToLower(name)
+	if _, ok := compressors[name]; !ok {
+		compressorOrder = append(compressorOrder, name)
+	}
+	compressors[name] = c
+}
+
+func GetCompressor(name string) (Compressor, bool) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+
+	c, ok := compressors[strings.ToLower(name)]
+	return c, ok
+}
+
+// SupportedEncodings returns names of registered encodings in order of preference
+func SupportedEncodings() []string {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+
+	return append([]string(nil), compressorOrder...)
+}
+
+func Compress(encoding string, data []byte) ([]byte, error) {
+	c, ok := GetCompressor(encoding)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncoding, encoding)
+	}
+
+	buf := new(bytes.Buffer)
+	w, err := c.Compress(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Decompress fails when decompressed data is larger than limit bytes
+func Decompress(encoding string, data []byte, limit int) ([]byte, error) {
+	c, ok := GetCompressor(encoding)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncoding, encoding)
+	}
+
+	r, err := c.Decompress(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	out, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(out) > limit {
+		return nil, fmt.Errorf("decompressed payload is larger than %d bytes", limit)
+	}
+
+	return out, nil
+}
+
+// NegotiateEncoding picks the first of accepted encodings which is
+// registered, empty string if none is. Values may be comma separated lists.
+func NegotiateEncoding(accepted []string) string {
+	for _, value := range accepted {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if _, ok := GetCompressor(name); ok {
+				return name
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,111 @@
+package hsp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// identityCompressor stores data as is, to test registration of encodings
+type identityCompressor struct{}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func (identityCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (identityCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	return r, nil
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	data := []byte(strings.Repeat(`{"name": "hsp", "values": [1, 2, 3]}`, 100))
+
+	for _, encoding := range []string{CE_GZIP, CE_DEFLATE} {
+		compressed, err := Compress(encoding, data)
+		if err != nil {
+			t.Fatalf("ERR: Failed to compress with %s: %v", encoding, err)
+		}
+
+		if len(compressed) >= len(data) {
+			t.Errorf("%s didn't make repetitive data smaller: %d bytes", encoding, len(compressed))
+		}
+
+		decompressed, err := Decompress(encoding, compressed, len(data))
+		if err != nil {
+			t.Fatalf("ERR: Failed to decompress with %s: %v", encoding, err)
+		}
+
+		if !bytes.Equal(decompressed, data) {
+			t.Errorf("%s round trip changed the data", encoding)
+		}
+
+		if _, err := Decompress(encoding, compressed, len(data)-1); err == nil {
+			t.Errorf("%s payload over the limit was accepted", encoding)
+		}
+	}
+
+	if _, err := Compress("brotli", data); !errors.Is(err, ErrUnsupportedEncoding) {
+		t.Error("Expected unsupported encoding, got:", err)
+	}
+}
+
+// registerCompressor registers encoding for duration of the test only
+func registerCompressor(t *testing.T, name string, c Compressor) {
+	t.Helper()
+
+	compressorsMu.RLock()
+	saved := maps.Clone(compressors)
+	savedOrder := slices.Clone(compressorOrder)
+	compressorsMu.RUnlock()
+
+	t.Cleanup(func() {
+		compressorsMu.Lock()
+		defer compressorsMu.Unlock()
+
+		compressors = saved
+		compressorOrder = savedOrder
+	})
+
+	RegisterCompressor(name, c)
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	registerCompressor(t, "x-identity", identityCompressor{})
+
+	for _, tc := range []struct {
+		accepted []string
+		expected string
+	}{
+		{[]string{"deflate", "gzip"}, CE_DEFLATE},
+		{[]string{"br, GZIP"}, CE_GZIP},
+		{[]string{"br"}, ""},
+		{nil, ""},
+		{[]string{"x-identity"}, "x-identity"},
+	} {
+		if encoding := NegotiateEncoding(tc.accepted); encoding != tc.expected {
+			t.Errorf("Negotiated %q for %q, expected %q", encoding, tc.accepted, tc.expected)
+		}
+	}
+
+	if encodings := SupportedEncodings(); encodings[len(encodings)-1] != "x-identity" {
+		t.Errorf("Registered encoding is not supported: %q", encodings)
+	}
+
+	t.Run("cleanup", func(t *testing.T) {
+		registerCompressor(t, "x-scoped", identityCompressor{})
+	})
+
+	if _, ok := GetCompressor("x-scoped"); ok {
+		t.Error("Encoding registered by a test outlived it")
+	}
+}
@@ -1,25 +1,120 @@
 package hsp
 
 import (
-	"bytes"
+	"crypto/cipher"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
+	"sync"
+	"time"
+)
+
+var ErrVersionMismatch = errors.New("packet version mismatch")
+
+var ErrNonceExhausted = errors.New("all nonces of the connection are used")
+
+var ErrInvalidFragment = errors.New("invalid packet fragment")
+
+var ErrReassemblyLimit = errors.New("fragment reassembly limit exceeded")
+
+var ErrReservedFlags = errors.New("packet has flags reserved for connection")
+
+var ErrPacketTooLarge = errors.New("packet exceeds the size limit")
+
+// ReplayError is returned when received packet doesn't carry the next
+// expected sequence number, meaning it was replayed, reordered or dropped
+type ReplayError struct {
+	Expected uint64
+	Received uint64
+}
+
+func (e *ReplayError) Error() string {
+	return fmt.Sprintf("unexpected packet sequence number %d (expected %d)", e.Received, e.Expected)
+}
+
+const (
+	preambleSize = 16
+	nonceSize    = 12
+	tagSize      = 16
+	// Larger write buffers are not kept around after sending huge packets
+	maxRetainedBuffer = 1 << 20
+)
+
+const (
+	DefaultRekeyAfterBytes   uint64 = 1 << 36
+	DefaultRekeyAfterPackets uint64 = 1 << 32
+	DefaultMaxFragmentSize   int    = 1 << 20
+	// Peer may keep this many payloads unfinished at once
+	DefaultMaxReassemblies int = 64
 )
 
 type Connection struct {
-	Conn      net.Conn
-	Keys      *KeyPair
-	SharedKey [32]byte
+	Conn net.Conn
+	Keys *KeyPair
+	// Packets are sealed with SendKey and opened with RecvKey
+	SendKey [32]byte
+	RecvKey [32]byte
+	Suite   CipherSuite
+	// Identity public key proven by the peer during handshake, nil if the
+	// peer is anonymous
+	PeerIdentity *[32]byte
+	// Session was resumed with a ticket instead of full key exchange
+	Resumed bool
+	// Client's ephemeral public key, identifies the connection in key logs
+	ClientRandom [32]byte
+	// Send key is ratcheted forward after this amount of sent bytes or
+	// packets, 0 disables the threshold
+	RekeyAfterBytes   uint64
+	RekeyAfterPackets uint64
+	// Larger payloads are split into several packets, so they don't hold up
+	// other requests of multiplexed connection. 0 disables fragmentation.
+	MaxFragmentSize int
+	// Limits of incoming fragments: bytes buffered for all unfinished
+	// payloads together and the number of such payloads. Connection fails
+	// once the peer exceeds either of them. Payload of a single packet
+	// can't be larger than MaxReassembledSize either.
+	MaxReassembledSize int
+	MaxReassemblies    int
+	// Compressed payloads are decompressed by Read up to this size
+	MaxDecompressedSize int
+	// Sequence numbers of the next sent and received packets, used as nonces
+	sendSeq   uint64
+	recvSeq   uint64
+	sentBytes uint64
+	sealer    cipher.AEAD
+	opener    cipher.AEAD
+	writeBuf  []byte
+	mu        sync.Mutex
+	// Session ticket issued by the server, sent before the first packet
+	ticket []byte
+	// Receives session tickets on the client
+	onTicket func(ticket []byte, lifetime time.Duration)
+	// Connection was opened by this side
+	client bool
+	// Payloads being reassembled, by request id
+	fragments map[uint32]*Packet
+	// Bytes buffered in fragments
+	reassembled int
 }
 
-func NewConnection(conn net.Conn, keys *KeyPair, sharedKey [32]byte) *Connection {
+func NewConnection(conn net.Conn, keys *KeyPair, sendKey, recvKey [32]byte) *Connection {
 	return &Connection{
-		Conn:      conn,
-		Keys:      keys,
-		SharedKey: sharedKey,
+		Conn:    conn,
+		Keys:    keys,
+		SendKey: sendKey,
+		RecvKey: recvKey,
+		Suite:   SUITE_AES_256_GCM,
+
+		RekeyAfterBytes:   DefaultRekeyAfterBytes,
+		RekeyAfterPackets: DefaultRekeyAfterPackets,
+		MaxFragmentSize:   DefaultMaxFragmentSize,
+
+		MaxReassembledSize:  DefaultMaxDecompressedSize,
+		MaxReassemblies:     DefaultMaxReassemblies,
+		MaxDecompressedSize: DefaultMaxDecompressedSize,
 	}
 }
 
@@ -28,122 +123,390 @@ func (c *Connection) Close() error {
 }
 
 func (c *Connection) Read() (*Packet, error) {
-	rpkt := &RawPacket{}
+	for {
+		pkt, err := c.readPacket()
+		if err != nil {
+			return nil, err
+		}
+
+		if pkt.IsControl() {
+			if err := c.handleControl(pkt); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		pkt, err = c.reassemble(pkt)
+		if err != nil {
+			return nil, err
+		}
+
+		if pkt == nil {
+			continue
+		}
+
+		if pkt.HasFlag(F_COMPRESSED) {
+			if err := c.decompress(pkt); err != nil {
+				return nil, err
+			}
+		}
+
+		return pkt, nil
+	}
+}
 
-	err := binary.Read(c.Conn, binary.BigEndian, &rpkt.Magic)
+// decompress replaces compressed payload with the original one, so packets
+// returned by Read are never compressed
+func (c *Connection) decompress(pkt *Packet) error {
+	encoding := pkt.Headers.Get(H_CONTENT_ENCODING)
+
+	payload, err := Decompress(encoding, pkt.Payload, c.MaxDecompressedSize)
 	if err != nil {
+		return fmt.Errorf("failed to decompress payload of request %d: %w", pkt.RequestID, err)
+	}
+
+	pkt.Payload = payload
+	pkt.Headers.Del(H_CONTENT_ENCODING)
+	pkt.ClearFlag(F_COMPRESSED)
+
+	return nil
+}
+
+func (c *Connection) handleControl(pkt *Packet) error {
+	switch {
+	case pkt.HasFlag(F_TICKET):
+		if c.onTicket != nil && len(pkt.Payload) > 4 {
+			lifetime := time.Duration(binary.BigEndian.Uint32(pkt.Payload[:4])) * time.Second
+			c.onTicket(pkt.Payload[4:], lifetime)
+		}
+	case pkt.HasFlag(F_REKEY):
+		// Peer has switched to the next key after this packet
+		next, err := RatchetKey(c.RecvKey)
+		if err != nil {
+			return err
+		}
+
+		c.RecvKey = next
+		c.opener = nil
+		c.recvSeq = 0
+	}
+
+	return nil
+}
+
+// reassemble joins fragments of the payload, nil is returned until the last
+// fragment arrives. Fragments of different requests may be interleaved.
+func (c *Connection) reassemble(pkt *Packet) (*Packet, error) {
+	first, ok := c.fragments[pkt.RequestID]
+	if !ok {
+		if !pkt.HasFlag(F_MORE_FRAGMENTS) {
+			return pkt, nil
+		}
+
+		if len(c.fragments) >= c.MaxReassemblies {
+			return nil, fmt.Errorf("%w: more than %d payloads are unfinished", ErrReassemblyLimit, c.MaxReassemblies)
+		}
+
+		if err := c.reserveFragment(pkt); err != nil {
+			return nil, err
+		}
+
+		if c.fragments == nil {
+			c.fragments = make(map[uint32]*Packet)
+		}
+		c.fragments[pkt.RequestID] = pkt
+		return nil, nil
+	}
+
+	if len(pkt.Headers) > 0 {
+		return nil, fmt.Errorf("%w: continuation of request %d carries headers", ErrInvalidFragment, pkt.RequestID)
+	}
+
+	if err := c.reserveFragment(pkt); err != nil {
+		return nil, err
+	}
+
+	first.Payload = append(first.Payload, pkt.Payload...)
+	if pkt.HasFlag(F_MORE_FRAGMENTS) {
+		return nil, nil
+	}
+
+	delete(c.fragments, pkt.RequestID)
+	c.reassembled -= len(first.Payload)
+
+	// Last fragment has flags of the whole packet
+	first.Flags = pkt.Flags
+	return first, nil
+}
+
+func (c *Connection) reserveFragment(pkt *Packet) error {
+	if c.reassembled+len(pkt.Payload) > c.MaxReassembledSize {
+		return fmt.Errorf("%w: more than %d bytes of fragments are buffered", ErrReassemblyLimit, c.MaxReassembledSize)
+	}
+
+	c.reassembled += len(pkt.Payload)
+	return nil
+}
+
+func (c *Connection) readPacket() (*Packet, error) {
+	rpkt := &RawPacket{}
+
+	// Everything before the nonce is authenticated along with encrypted data
+	var head [preambleSize + nonceSize]byte
+	if _, err := io.ReadFull(c.Conn, head[:4]); err != nil {
 		return nil, err
 	}
 
+	rpkt.Magic = binary.BigEndian.Uint32(head[0:4])
 	if rpkt.Magic != Magic {
 		return nil, errors.New("Magic bytes are invalid")
 	}
 
-	err = binary.Read(c.Conn, binary.BigEndian, &rpkt.Version)
-	if err != nil {
+	if _, err := io.ReadFull(c.Conn, head[4:]); err != nil {
 		return nil, err
 	}
 
-	err = binary.Read(c.Conn, binary.BigEndian, &rpkt.Flags)
-	if err != nil {
-		return nil, err
+	rpkt.Version = head[4]
+
+	// Peers with other versions derive different keys, no point in going further
+	if int(rpkt.Version) != PacketVersion {
+		return nil, fmt.Errorf("%w: received %d, expected %d", ErrVersionMismatch, rpkt.Version, PacketVersion)
 	}
 
-	err = binary.Read(c.Conn, binary.BigEndian, &rpkt.HeaderSize)
-	if err != nil {
-		return nil, err
+	rpkt.Flags = head[5]
+	rpkt.RequestID = binary.BigEndian.Uint32(head[6:10])
+	rpkt.HeaderSize = binary.BigEndian.Uint16(head[10:12])
+	rpkt.PayloadSize = binary.BigEndian.Uint32(head[12:16])
+	rpkt.Nonce = head[preambleSize:]
+
+	if seq := NonceSequence(rpkt.Nonce); seq != c.recvSeq {
+		return nil, &ReplayError{Expected: c.recvSeq, Received: seq}
 	}
 
-	err = binary.Read(c.Conn, binary.BigEndian, &rpkt.PayloadSize)
-	if err != nil {
-		return nil, err
+	// Sizes aren't authenticated yet, so they are checked before anything
+	// is allocated for the packet
+	if int(rpkt.HeaderSize) > MaxHeaderBytes {
+		return nil, fmt.Errorf("%w: %d bytes of headers", ErrPacketTooLarge, rpkt.HeaderSize)
 	}
 
-	rpkt.Nonce = make([]byte, 12)
-	if _, err := io.ReadFull(c.Conn, rpkt.Nonce); err != nil {
-		return nil, err
+	if uint64(rpkt.PayloadSize) > uint64(max(c.MaxReassembledSize, 0)) {
+		return nil, fmt.Errorf("%w: %d bytes of payload", ErrPacketTooLarge, rpkt.PayloadSize)
 	}
 
-	data := make([]byte, uint32(rpkt.HeaderSize)+rpkt.PayloadSize)
+	size := int(rpkt.HeaderSize) + int(rpkt.PayloadSize)
+
+	data := make([]byte, size+tagSize)
 	if _, err := io.ReadFull(c.Conn, data); err != nil {
 		return nil, err
 	}
 
-	rpkt.Mac = make([]byte, 16)
-	if _, err := io.ReadFull(c.Conn, rpkt.Mac); err != nil {
-		return nil, err
+	rpkt.Mac = data[size:]
+
+	if c.opener == nil {
+		opener, err := c.Suite.NewAEAD(c.RecvKey[:])
+		if err != nil {
+			return nil, err
+		}
+		c.opener = opener
 	}
 
-	decrypted, err := Decrypt(c.SharedKey[:], rpkt.Nonce, append(data, rpkt.Mac...))
+	decrypted, err := c.opener.Open(data[:0], rpkt.Nonce, data, head[:preambleSize])
 	if err != nil {
 		return nil, err
 	}
 
+	c.recvSeq++
+
 	rpkt.Header = decrypted[:rpkt.HeaderSize]
-	rpkt.Payload = decrypted[rpkt.HeaderSize : uint32(rpkt.HeaderSize)+rpkt.PayloadSize]
+	rpkt.Payload = decrypted[rpkt.HeaderSize:]
 
 	pkt := &Packet{
-		Version: int(rpkt.Version),
-		Flags:   int(rpkt.Flags),
-		Headers: make(map[string]string),
-		Payload: rpkt.Payload,
+		Version:   int(rpkt.Version),
+		Flags:     int(rpkt.Flags),
+		RequestID: rpkt.RequestID,
+		Headers:   make(Header),
+		Payload:   rpkt.Payload,
 	}
 
-	ParseHeaders(rpkt.Header, &pkt.Headers)
+	if err := ParseHeaders(rpkt.Header, &pkt.Headers); err != nil {
+		return nil, err
+	}
 
 	return pkt, nil
 }
 
+// Write sends the packet, splitting its payload into fragments if needed.
+// Packets with the same request id must not be written concurrently.
+// Fragment and control flags are set only by the connection itself.
 func (c *Connection) Write(packet *Packet) (n int, err error) {
-	buf := new(bytes.Buffer)
+	if packet.Flags&connectionFlags != 0 {
+		return 0, fmt.Errorf("%w: %s", ErrReservedFlags, FormatFlags(packet.Flags&connectionFlags))
+	}
+
+	if c.MaxFragmentSize <= 0 || len(packet.Payload) <= c.MaxFragmentSize {
+		return c.send(packet)
+	}
+
+	// Fragments are sent one by one, so packets of other requests can be
+	// sent in between
+	payload := packet.Payload
+	for first := true; ; first = false {
+		size := min(len(payload), c.MaxFragmentSize)
+
+		fragment := &Packet{
+			Version:   packet.Version,
+			Flags:     packet.Flags,
+			RequestID: packet.RequestID,
+			Headers:   Header{},
+			Payload:   payload[:size],
+		}
+
+		if first {
+			fragment.Headers = packet.Headers
+		}
+
+		payload = payload[size:]
+		if len(payload) > 0 {
+			fragment.SetFlag(F_MORE_FRAGMENTS)
+		}
+
+		written, err := c.send(fragment)
+		if err != nil {
+			return n, err
+		}
+		n += written
+
+		if len(payload) == 0 {
+			return n, nil
+		}
+	}
+}
+
+func (c *Connection) send(packet *Packet) (n int, err error) {
+	// Multiplexed connections are written from several goroutines, packets
+	// have to be sent in order of their sequence numbers
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ticket != nil {
+		control := BuildPacket(Header{}, c.ticket)
+		control.Flags = F_CONTROL | F_TICKET
 
-	if err := binary.Write(buf, binary.BigEndian, Magic); err != nil {
-		return 0, fmt.Errorf("failed to write magic into packet: %s", err.Error())
+		if _, err := c.writePacket(control); err != nil {
+			return 0, err
+		}
+		c.ticket = nil
 	}
 
-	if err := binary.Write(buf, binary.BigEndian, uint8(packet.Version)); err != nil {
-		return 0, fmt.Errorf("failed to write version into packet: %s", err.Error())
+	n, err = c.writePacket(packet)
+	if err != nil {
+		return 0, err
 	}
 
-	if err := binary.Write(buf, binary.BigEndian, uint8(packet.Flags)); err != nil {
-		return 0, fmt.Errorf("failed to write flags into packet: %s", err.Error())
+	if (c.RekeyAfterBytes > 0 && c.sentBytes >= c.RekeyAfterBytes) ||
+		(c.RekeyAfterPackets > 0 && c.sendSeq >= c.RekeyAfterPackets) {
+		if err := c.rekey(); err != nil {
+			return n, err
+		}
 	}
 
-	rawHeaders := SerializeHeaders(&packet.Headers)
+	return n, nil
+}
+
+// Rekey tells the peer to switch to the next key and ratchets the send key
+// forward, it is done automatically once rekey thresholds are reached
+func (c *Connection) Rekey() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.rekey()
+}
+
+func (c *Connection) rekey() error {
+	control := BuildPacket(Header{}, nil)
+	control.Flags = F_CONTROL | F_REKEY
 
-	data := append(rawHeaders, packet.Payload...)
+	if _, err := c.writePacket(control); err != nil {
+		return err
+	}
 
-	encrypted, nonce, err := Encrypt(c.SharedKey[:], data)
+	next, err := RatchetKey(c.SendKey)
 	if err != nil {
+		return err
+	}
+
+	c.SendKey = next
+	c.sealer = nil
+	c.sendSeq = 0
+	c.sentBytes = 0
+
+	return nil
+}
+
+func (c *Connection) writePacket(packet *Packet) (n int, err error) {
+	if c.sendSeq == math.MaxUint64 {
+		return 0, ErrNonceExhausted
+	}
+
+	if c.sealer == nil {
+		sealer, err := c.Suite.NewAEAD(c.SendKey[:])
+		if err != nil {
+			return 0, err
+		}
+		c.sealer = sealer
+	}
+
+	if err := ValidateHeaders(packet.Headers); err != nil {
 		return 0, err
 	}
 
-	mac := encrypted[len(encrypted)-16:]
+	rawHeaders := SerializeHeaders(packet.Headers)
 
 	headerSize := len(rawHeaders)
 	payloadSize := len(packet.Payload)
 
-	if err := binary.Write(buf, binary.BigEndian, uint16(headerSize)); err != nil {
-		return 0, errors.New(fmt.Sprintf("Failed to write header size into packet: %s", err.Error()))
+	if headerSize > math.MaxUint16 {
+		return 0, fmt.Errorf("headers are too large: %d bytes", headerSize)
 	}
 
-	if err := binary.Write(buf, binary.BigEndian, uint32(payloadSize)); err != nil {
-		return 0, errors.New(fmt.Sprintf("Failed to write payload size into packet: %s", err.Error()))
+	if uint64(payloadSize) > math.MaxUint32 {
+		return 0, fmt.Errorf("payload is too large: %d bytes", payloadSize)
 	}
 
-	if _, err := buf.Write(nonce[:12]); err != nil {
-		return 0, errors.New(fmt.Sprintf("Failed to write nonce: %s", err.Error()))
-	}
+	// Whole packet is built in one buffer and sealed in place
+	frameSize := preambleSize + nonceSize + headerSize + payloadSize + tagSize
 
-	if _, err := buf.Write(encrypted[:len(encrypted)-16]); err != nil {
-		return 0, errors.New(fmt.Sprintf("Failed to write encrypted data: %s", err.Error()))
+	buf := c.writeBuf[:0]
+	if cap(buf) < frameSize {
+		buf = make([]byte, 0, frameSize)
 	}
 
-	if _, err := buf.Write(mac); err != nil {
-		return 0, errors.New(fmt.Sprintf("Failed to write mac: %s", err.Error()))
+	buf = binary.BigEndian.AppendUint32(buf, Magic)
+	buf = append(buf, uint8(packet.Version), uint8(packet.Flags))
+	buf = binary.BigEndian.AppendUint32(buf, packet.RequestID)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(headerSize))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(payloadSize))
+	// Same layout as SequenceNonce, without allocating it separately
+	buf = binary.BigEndian.AppendUint64(append(buf, 0, 0, 0, 0), c.sendSeq)
+	c.sendSeq++
+	c.sentBytes += uint64(headerSize + payloadSize)
+
+	buf = append(buf, rawHeaders...)
+	buf = append(buf, packet.Payload...)
+
+	plain := buf[preambleSize+nonceSize:]
+	nonce := buf[preambleSize : preambleSize+nonceSize]
+
+	sealed := c.sealer.Seal(plain[:0], nonce, plain, buf[:preambleSize])
+	frame := buf[:preambleSize+nonceSize+len(sealed)]
+
+	if cap(frame) <= maxRetainedBuffer {
+		c.writeBuf = frame[:0]
+	} else {
+		c.writeBuf = nil
 	}
 
-	n, err = c.Conn.Write(buf.Bytes())
+	n, err = c.Conn.Write(frame)
 	if err != nil {
 		return 0, errors.New(fmt.Sprintf("Failed to send packet over connection: %s", err.Error()))
 	}
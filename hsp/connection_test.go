@@ -0,0 +1,533 @@
+package hsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"testing"
+)
+
+func TestConnectionRoundTrip(t *testing.T) {
+	left, right := net.Pipe()
+
+	keys, err := DeriveSessionKeys([]byte("secret"), []byte("transcript"))
+	if err != nil {
+		t.Fatal("ERR: Failed to derive keys:", err)
+	}
+
+	sender := NewConnection(left, nil, keys.ClientToServer, keys.ServerToClient)
+	receiver := NewConnection(right, nil, keys.ServerToClient, keys.ClientToServer)
+
+	defer sender.Close()
+	defer receiver.Close()
+
+	pkt := BuildPacket(Header{H_ROUTE: {"/echo"}}, []byte("Hello, World!"))
+	pkt.RequestID = 42
+	pkt.Flags = F_KEEP_ALIVE
+
+	go func() {
+		if _, err := sender.Write(pkt); err != nil {
+			t.Error("ERR: Failed to write packet:", err)
+		}
+	}()
+
+	received, err := receiver.Read()
+	if err != nil {
+		t.Fatal("ERR: Failed to read packet:", err)
+	}
+
+	if received.RequestID != pkt.RequestID {
+		t.Errorf("Request id %d doesn't match sent one %d", received.RequestID, pkt.RequestID)
+	}
+
+	if received.Flags != pkt.Flags {
+		t.Errorf("Flags %d don't match sent ones %d", received.Flags, pkt.Flags)
+	}
+
+	if received.Headers.Get(H_ROUTE) != "/echo" {
+		t.Errorf("Route header '%s' doesn't match sent one", received.Headers.Get(H_ROUTE))
+	}
+
+	if !bytes.Equal(received.Payload, pkt.Payload) {
+		t.Error("Received payload doesn't match sent one")
+	}
+}
+
+func TestConnectionVersionMismatch(t *testing.T) {
+	left, right := net.Pipe()
+
+	keys, err := DeriveSessionKeys([]byte("secret"), []byte("transcript"))
+	if err != nil {
+		t.Fatal("ERR: Failed to derive keys:", err)
+	}
+
+	sender := NewConnection(left, nil, keys.ClientToServer, keys.ServerToClient)
+	receiver := NewConnection(right, nil, keys.ServerToClient, keys.ClientToServer)
+
+	defer sender.Close()
+	defer receiver.Close()
+
+	pkt := BuildPacket(Header{}, nil)
+	pkt.Version = PacketVersion - 1
+
+	go sender.Write(pkt)
+
+	if _, err := receiver.Read(); !errors.Is(err, ErrVersionMismatch) {
+		t.Error("Expected version mismatch, got:", err)
+	}
+}
+
+// bufferConn is a connection writing into and reading from the same buffer
+type bufferConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (b *bufferConn) Read(p []byte) (int, error)  { return b.buf.Read(p) }
+func (b *bufferConn) Write(p []byte) (int, error) { return b.buf.Write(p) }
+func (b *bufferConn) Close() error                { return nil }
+
+func TestConnectionRejectsReplay(t *testing.T) {
+	keys, err := DeriveSessionKeys([]byte("secret"), []byte("transcript"))
+	if err != nil {
+		t.Fatal("ERR: Failed to derive keys:", err)
+	}
+
+	sent := &bufferConn{}
+	sender := NewConnection(sent, nil, keys.ClientToServer, keys.ServerToClient)
+
+	if _, err := sender.Write(BuildPacket(Header{}, []byte("transfer 100"))); err != nil {
+		t.Fatal("ERR: Failed to write packet:", err)
+	}
+
+	captured := sent.buf.Bytes()
+
+	replayed := &bufferConn{}
+	replayed.buf.Write(captured)
+	replayed.buf.Write(captured)
+
+	receiver := NewConnection(replayed, nil, keys.ServerToClient, keys.ClientToServer)
+
+	if _, err := receiver.Read(); err != nil {
+		t.Fatal("ERR: Failed to read original packet:", err)
+	}
+
+	var replayErr *ReplayError
+	if _, err := receiver.Read(); !errors.As(err, &replayErr) {
+		t.Error("Expected replayed packet to be rejected, got:", err)
+	}
+}
+
+func TestConnectionDetectsTamperedPreamble(t *testing.T) {
+	keys, err := DeriveSessionKeys([]byte("secret"), []byte("transcript"))
+	if err != nil {
+		t.Fatal("ERR: Failed to derive keys:", err)
+	}
+
+	conn := &bufferConn{}
+	sender := NewConnection(conn, nil, keys.ClientToServer, keys.ServerToClient)
+	receiver := NewConnection(conn, nil, keys.ServerToClient, keys.ClientToServer)
+
+	if _, err := sender.Write(BuildPacket(Header{}, []byte("Hello, World!"))); err != nil {
+		t.Fatal("ERR: Failed to write packet:", err)
+	}
+
+	// Flip keep-alive bit of the flags
+	conn.buf.Bytes()[5] ^= byte(F_KEEP_ALIVE)
+
+	if _, err := receiver.Read(); err == nil {
+		t.Error("Packet with tampered flags was accepted")
+	}
+}
+
+func TestConnectionRekey(t *testing.T) {
+	keys, err := DeriveSessionKeys([]byte("secret"), []byte("transcript"))
+	if err != nil {
+		t.Fatal("ERR: Failed to derive keys:", err)
+	}
+
+	conn := &bufferConn{}
+	sender := NewConnection(conn, nil, keys.ClientToServer, keys.ServerToClient)
+	receiver := NewConnection(conn, nil, keys.ServerToClient, keys.ClientToServer)
+
+	sender.RekeyAfterPackets = 2
+
+	for i := range 5 {
+		payload := []byte{byte(i)}
+		if _, err := sender.Write(BuildPacket(Header{}, payload)); err != nil {
+			t.Fatal("ERR: Failed to write packet:", err)
+		}
+	}
+
+	if sender.SendKey == keys.ClientToServer {
+		t.Error("Send key wasn't ratcheted after reaching the threshold")
+	}
+
+	for i := range 5 {
+		pkt, err := receiver.Read()
+		if err != nil {
+			t.Fatalf("ERR: Failed to read packet %d: %v", i, err)
+		}
+
+		if !bytes.Equal(pkt.Payload, []byte{byte(i)}) {
+			t.Errorf("Packet %d has unexpected payload %v", i, pkt.Payload)
+		}
+	}
+
+	if receiver.RecvKey != sender.SendKey {
+		t.Error("Receiver didn't follow sender to the next key")
+	}
+}
+
+func TestConnectionFragments(t *testing.T) {
+	keys, err := DeriveSessionKeys([]byte("secret"), []byte("transcript"))
+	if err != nil {
+		t.Fatal("ERR: Failed to derive keys:", err)
+	}
+
+	conn := &bufferConn{}
+	sender := NewConnection(conn, nil, keys.ClientToServer, keys.ServerToClient)
+	receiver := NewConnection(conn, nil, keys.ServerToClient, keys.ClientToServer)
+
+	sender.MaxFragmentSize = 4
+
+	large := BuildPacket(Header{H_ROUTE: {"/large"}}, []byte("Hello, World!"))
+	large.RequestID = 1
+	large.SetFlag(F_KEEP_ALIVE)
+
+	if _, err := sender.Write(large); err != nil {
+		t.Fatal("ERR: Failed to write packet:", err)
+	}
+
+	// Fragment of one request interleaved with another request
+	first := BuildPacket(Header{H_ROUTE: {"/a"}}, []byte("abc"))
+	first.RequestID = 2
+	first.SetFlag(F_MORE_FRAGMENTS)
+	other := BuildPacket(Header{H_ROUTE: {"/b"}}, []byte("other"))
+	other.RequestID = 3
+	last := BuildPacket(Header{}, []byte("def"))
+	last.RequestID = 2
+	unknownControl := BuildPacket(Header{}, []byte("ignored"))
+	unknownControl.SetFlag(F_CONTROL)
+
+	for _, pkt := range []*Packet{first, unknownControl, other, last} {
+		if _, err := sender.send(pkt); err != nil {
+			t.Fatal("ERR: Failed to write packet:", err)
+		}
+	}
+
+	for _, expected := range []struct {
+		id      uint32
+		route   string
+		payload string
+	}{
+		{1, "/large", "Hello, World!"},
+		{3, "/b", "other"},
+		{2, "/a", "abcdef"},
+	} {
+		pkt, err := receiver.Read()
+		if err != nil {
+			t.Fatal("ERR: Failed to read packet:", err)
+		}
+
+		if pkt.RequestID != expected.id || pkt.Headers.Get(H_ROUTE) != expected.route || string(pkt.Payload) != expected.payload {
+			t.Errorf("Unexpected packet %d %q with payload %q", pkt.RequestID, pkt.Headers.Get(H_ROUTE), pkt.Payload)
+		}
+
+		if pkt.HasFlag(F_MORE_FRAGMENTS) {
+			t.Error("Reassembled packet still has more fragments flag")
+		}
+	}
+
+	if len(receiver.fragments) != 0 {
+		t.Errorf("%d payloads are left unassembled", len(receiver.fragments))
+	}
+}
+
+func TestConnectionRejectsFragmentHeaders(t *testing.T) {
+	keys, err := DeriveSessionKeys([]byte("secret"), []byte("transcript"))
+	if err != nil {
+		t.Fatal("ERR: Failed to derive keys:", err)
+	}
+
+	conn := &bufferConn{}
+	sender := NewConnection(conn, nil, keys.ClientToServer, keys.ServerToClient)
+	receiver := NewConnection(conn, nil, keys.ServerToClient, keys.ClientToServer)
+
+	first := BuildPacket(Header{H_ROUTE: {"/a"}}, []byte("abc"))
+	first.SetFlag(F_MORE_FRAGMENTS)
+	last := BuildPacket(Header{H_ROUTE: {"/b"}}, []byte("def"))
+
+	for _, pkt := range []*Packet{first, last} {
+		if _, err := sender.send(pkt); err != nil {
+			t.Fatal("ERR: Failed to write packet:", err)
+		}
+	}
+
+	if _, err := receiver.Read(); !errors.Is(err, ErrInvalidFragment) {
+		t.Error("Expected invalid fragment, got:", err)
+	}
+}
+
+func TestConnectionReassemblyLimits(t *testing.T) {
+	keys, err := DeriveSessionKeys([]byte("secret"), []byte("transcript"))
+	if err != nil {
+		t.Fatal("ERR: Failed to derive keys:", err)
+	}
+
+	unfinished := func(id uint32, payload []byte) *Packet {
+		pkt := BuildPacket(Header{}, payload)
+		pkt.RequestID = id
+		pkt.SetFlag(F_MORE_FRAGMENTS)
+		return pkt
+	}
+
+	// Too many payloads left unfinished
+	conn := &bufferConn{}
+	sender := NewConnection(conn, nil, keys.ClientToServer, keys.ServerToClient)
+	receiver := NewConnection(conn, nil, keys.ServerToClient, keys.ClientToServer)
+	receiver.MaxReassemblies = 3
+
+	for id := range uint32(4) {
+		if _, err := sender.send(unfinished(id+1, []byte("x"))); err != nil {
+			t.Fatal("ERR: Failed to write packet:", err)
+		}
+	}
+
+	if _, err := receiver.Read(); !errors.Is(err, ErrReassemblyLimit) {
+		t.Error("Expected reassembly limit, got:", err)
+	}
+
+	// Too many bytes buffered across payloads
+	conn = &bufferConn{}
+	sender = NewConnection(conn, nil, keys.ClientToServer, keys.ServerToClient)
+	receiver = NewConnection(conn, nil, keys.ServerToClient, keys.ClientToServer)
+	receiver.MaxReassembledSize = 10
+
+	for _, pkt := range []*Packet{unfinished(1, make([]byte, 4)), unfinished(2, make([]byte, 4)), unfinished(1, make([]byte, 4))} {
+		if _, err := sender.send(pkt); err != nil {
+			t.Fatal("ERR: Failed to write packet:", err)
+		}
+	}
+
+	if _, err := receiver.Read(); !errors.Is(err, ErrReassemblyLimit) {
+		t.Error("Expected reassembly limit, got:", err)
+	}
+
+	// Finished payloads don't count towards the limit
+	conn = &bufferConn{}
+	sender = NewConnection(conn, nil, keys.ClientToServer, keys.ServerToClient)
+	receiver = NewConnection(conn, nil, keys.ServerToClient, keys.ClientToServer)
+	sender.MaxFragmentSize = 4
+	receiver.MaxReassembledSize = 10
+
+	for range 3 {
+		if _, err := sender.Write(BuildPacket(Header{}, make([]byte, 10))); err != nil {
+			t.Fatal("ERR: Failed to write packet:", err)
+		}
+
+		if _, err := receiver.Read(); err != nil {
+			t.Fatal("ERR: Failed to read packet:", err)
+		}
+	}
+}
+
+func TestConnectionRejectsLargePackets(t *testing.T) {
+	keys, err := DeriveSessionKeys([]byte("secret"), []byte("transcript"))
+	if err != nil {
+		t.Fatal("ERR: Failed to derive keys:", err)
+	}
+
+	conn := &bufferConn{}
+	sender := NewConnection(conn, nil, keys.ClientToServer, keys.ServerToClient)
+	receiver := NewConnection(conn, nil, keys.ServerToClient, keys.ClientToServer)
+	sender.MaxFragmentSize = 0
+	receiver.MaxReassembledSize = 1024
+
+	if _, err := sender.Write(BuildPacket(Header{}, make([]byte, 1<<20))); err != nil {
+		t.Fatal("ERR: Failed to write packet:", err)
+	}
+
+	if _, err := receiver.Read(); !errors.Is(err, ErrPacketTooLarge) {
+		t.Error("Expected too large packet, got:", err)
+	}
+
+	// Forged sizes are rejected before the rest of the packet arrives
+	for _, sizes := range [][2]uint32{{math.MaxUint16, 0}, {0, math.MaxUint32}} {
+		conn := &bufferConn{}
+		receiver := NewConnection(conn, nil, keys.ServerToClient, keys.ClientToServer)
+
+		preamble := binary.BigEndian.AppendUint32(nil, Magic)
+		preamble = append(preamble, byte(PacketVersion), 0, 0, 0, 0, 0)
+		preamble = binary.BigEndian.AppendUint16(preamble, uint16(sizes[0]))
+		preamble = binary.BigEndian.AppendUint32(preamble, sizes[1])
+		conn.buf.Write(append(preamble, SequenceNonce(0)...))
+
+		if _, err := receiver.Read(); !errors.Is(err, ErrPacketTooLarge) {
+			t.Errorf("Expected too large packet with sizes %v, got: %v", sizes, err)
+		}
+	}
+}
+
+func TestConnectionDecompressesPayload(t *testing.T) {
+	keys, err := DeriveSessionKeys([]byte("secret"), []byte("transcript"))
+	if err != nil {
+		t.Fatal("ERR: Failed to derive keys:", err)
+	}
+
+	conn := &bufferConn{}
+	sender := NewConnection(conn, nil, keys.ClientToServer, keys.ServerToClient)
+	receiver := NewConnection(conn, nil, keys.ServerToClient, keys.ClientToServer)
+
+	payload := bytes.Repeat([]byte("compressible "), 100)
+
+	res := NewTextResponse(string(payload))
+	compressed, err := Compress(CE_GZIP, res.Payload)
+	if err != nil {
+		t.Fatal("ERR: Failed to compress payload:", err)
+	}
+	res.Payload = compressed
+	res.AddHeader(H_CONTENT_ENCODING, CE_GZIP)
+
+	pkt := res.ToPacket()
+	pkt.SetFlag(F_COMPRESSED)
+
+	if _, err := sender.Write(pkt); err != nil {
+		t.Fatal("ERR: Failed to write packet:", err)
+	}
+
+	received, err := receiver.Read()
+	if err != nil {
+		t.Fatal("ERR: Failed to read packet:", err)
+	}
+
+	if !bytes.Equal(received.Payload, payload) {
+		t.Error("Received payload doesn't match the original one")
+	}
+
+	if received.HasFlag(F_COMPRESSED) || received.Headers.Has(H_CONTENT_ENCODING) {
+		t.Error("Decompressed packet is still marked as compressed")
+	}
+
+	// Decompressed size is limited
+	receiver.MaxDecompressedSize = len(payload) - 1
+	if _, err := sender.Write(pkt); err != nil {
+		t.Fatal("ERR: Failed to write packet:", err)
+	}
+
+	if _, err := receiver.Read(); err == nil {
+		t.Error("Payload over decompression limit was accepted")
+	}
+}
+
+func TestConnectionRejectsReservedFlags(t *testing.T) {
+	keys, err := DeriveSessionKeys([]byte("secret"), []byte("transcript"))
+	if err != nil {
+		t.Fatal("ERR: Failed to derive keys:", err)
+	}
+
+	conn := &bufferConn{}
+	sender := NewConnection(conn, nil, keys.ClientToServer, keys.ServerToClient)
+
+	for _, flags := range []int{F_CONTROL, F_CONTROL | F_REKEY, F_TICKET, F_MORE_FRAGMENTS | F_KEEP_ALIVE} {
+		pkt := BuildPacket(Header{}, []byte("data"))
+		pkt.Flags = flags
+
+		if _, err := sender.Write(pkt); !errors.Is(err, ErrReservedFlags) {
+			t.Errorf("Packet with flags %s was accepted: %v", FormatFlags(flags), err)
+		}
+	}
+
+	if conn.buf.Len() != 0 {
+		t.Error("Rejected packets were written to the connection")
+	}
+}
+
+func TestFormatFlags(t *testing.T) {
+	if s := FormatFlags(F_KEEP_ALIVE | F_END_STREAM | 1<<4); s != "keep-alive|end-stream|0x10" {
+		t.Errorf("Unexpected formatted flags %q", s)
+	}
+
+	if s := FormatFlags(0); s != "none" {
+		t.Errorf("Unexpected formatted flags %q", s)
+	}
+}
+
+// discardConn drops everything written into it
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(p []byte) (int, error) { return len(p), nil }
+
+// repeatConn endlessly reads the same packet
+type repeatConn struct {
+	net.Conn
+	data []byte
+	off  int
+}
+
+func (r *repeatConn) Read(p []byte) (int, error) {
+	if r.off == len(r.data) {
+		r.off = 0
+	}
+	n := copy(p, r.data[r.off:])
+	r.off += n
+	return n, nil
+}
+
+func benchmarkPayload() *Packet {
+	return BuildPacket(Header{
+		H_ROUTE:       {"/upload"},
+		H_DATA_FORMAT: {DF_BYTES},
+	}, make([]byte, 64*1024))
+}
+
+func BenchmarkConnectionWrite(b *testing.B) {
+	keys, err := DeriveSessionKeys([]byte("secret"), []byte("transcript"))
+	if err != nil {
+		b.Fatal("ERR: Failed to derive keys:", err)
+	}
+
+	conn := NewConnection(discardConn{}, nil, keys.ClientToServer, keys.ServerToClient)
+	pkt := benchmarkPayload()
+
+	b.SetBytes(int64(len(pkt.Payload)))
+	b.ReportAllocs()
+
+	for b.Loop() {
+		if _, err := conn.Write(pkt); err != nil {
+			b.Fatal("ERR: Failed to write packet:", err)
+		}
+	}
+}
+
+func BenchmarkConnectionRead(b *testing.B) {
+	keys, err := DeriveSessionKeys([]byte("secret"), []byte("transcript"))
+	if err != nil {
+		b.Fatal("ERR: Failed to derive keys:", err)
+	}
+
+	captured := &bufferConn{}
+	sender := NewConnection(captured, nil, keys.ClientToServer, keys.ServerToClient)
+	pkt := benchmarkPayload()
+
+	if _, err := sender.Write(pkt); err != nil {
+		b.Fatal("ERR: Failed to write packet:", err)
+	}
+
+	conn := NewConnection(&repeatConn{data: captured.buf.Bytes()}, nil, keys.ServerToClient, keys.ClientToServer)
+
+	b.SetBytes(int64(len(pkt.Payload)))
+	b.ReportAllocs()
+
+	for b.Loop() {
+		// Every read packet is the same one, so sequence check is skipped
+		conn.recvSeq = 0
+		if _, err := conn.Read(); err != nil {
+			b.Fatal("ERR: Failed to read packet:", err)
+		}
+	}
+}
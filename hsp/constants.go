@@ -10,10 +10,17 @@ import (
 const HSP_PORT = "998"
 
 const (
-	H_STATUS      = "status"
-	H_DATA_FORMAT = "data-format"
-	H_AUTH        = "auth"
-	H_ROUTE       = "route"
+	H_STATUS        = "status"
+	H_DATA_FORMAT   = "data-format"
+	H_AUTH          = "auth"
+	H_ROUTE         = "route"
+	H_STREAM        = "x-stream"
+	H_STREAM_KEY    = "x-stream-key"
+	H_STREAM_OFFSET = "x-stream-offset"
+	// Encoding of compressed payload, see F_COMPRESSED
+	H_CONTENT_ENCODING = "content-encoding"
+	// Encodings the client accepts in responses, in order of preference
+	H_ACCEPT_ENCODING = "accept-encoding"
 )
 
 const (
@@ -4,9 +4,15 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
 	"io"
+	"math"
 
 	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
 )
 
 type KeyPair struct {
@@ -48,29 +54,106 @@ func DeriveSharedKey(privateKey, peerPublicKey [32]byte) (sharedKey [32]byte, er
 	return
 }
 
+type SessionKeys struct {
+	ClientToServer [32]byte
+	ServerToClient [32]byte
+	// Keys proving to the peer that the same keys were derived
+	ClientConfirm [32]byte
+	ServerConfirm [32]byte
+	// Secret of the session resumed with a ticket later
+	Resumption [32]byte
+}
+
+// DeriveSessionKeys expands the secrets agreed during the key exchange into
+// a separate key for each direction. Transcript binds the keys to the
+// public keys exchanged during the handshake.
+func DeriveSessionKeys(secret, transcript []byte) (*SessionKeys, error) {
+	kdf := hkdf.New(sha256.New, secret, nil, transcript)
+
+	keys := &SessionKeys{}
+
+	if _, err := io.ReadFull(kdf, keys.ClientToServer[:]); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(kdf, keys.ServerToClient[:]); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(kdf, keys.ClientConfirm[:]); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(kdf, keys.ServerConfirm[:]); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(kdf, keys.Resumption[:]); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+const rekeyLabel = "hsp rekey"
+
+// RatchetKey derives the next key of the connection direction, the old key
+// can't be recovered from the new one
+func RatchetKey(key [32]byte) (next [32]byte, err error) {
+	kdf := hkdf.New(sha256.New, key[:], nil, []byte(rekeyLabel))
+	_, err = io.ReadFull(kdf, next[:])
+	return
+}
+
 func Encrypt(key []byte, data []byte) (encrypted []byte, nonce []byte, err error) {
-	block, err := aes.NewCipher(key)
+	nonce = make([]byte, 12)
+	_, err = io.ReadFull(rand.Reader, nonce)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	aesGCM, err := cipher.NewGCM(block)
+	encrypted, err = Seal(key, nonce, data, nil)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	nonce = make([]byte, aesGCM.NonceSize())
-	_, err = io.ReadFull(rand.Reader, nonce)
+	return encrypted, nonce, nil
+}
+
+func Seal(key []byte, nonce []byte, data []byte, additionalData []byte) (encrypted []byte, err error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	encrypted = aesGCM.Seal(nil, nonce, data, nil)
+	aesGCM, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
 
-	return encrypted, nonce, nil
+	return aesGCM.Seal(nil, nonce, data, additionalData), nil
+}
+
+// SequenceNonce builds a nonce from packet sequence number, so each nonce
+// is used only once per key and receiver can detect replayed packets
+func SequenceNonce(seq uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+func NonceSequence(nonce []byte) uint64 {
+	if len(nonce) != 12 || binary.BigEndian.Uint32(nonce[:4]) != 0 {
+		return math.MaxUint64
+	}
+	return binary.BigEndian.Uint64(nonce[4:])
 }
 
 func Decrypt(key []byte, nonce []byte, encrypted []byte) (data []byte, err error) {
+	return Open(key, nonce, encrypted, nil)
+}
+
+func Open(key []byte, nonce []byte, encrypted []byte, additionalData []byte) (data []byte, err error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
@@ -81,10 +164,37 @@ func Decrypt(key []byte, nonce []byte, encrypted []byte) (data []byte, err error
 		return nil, err
 	}
 
-	data, err = aesGCM.Open(nil, nonce, encrypted, nil)
+	data, err = aesGCM.Open(nil, nonce, encrypted, additionalData)
 	if err != nil {
 		return nil, err
 	}
 
 	return data, nil
 }
+
+func EncodePublicKey(key [32]byte) string {
+	return base64.StdEncoding.EncodeToString(key[:])
+}
+
+func ParsePublicKey(encoded string) ([32]byte, error) {
+	return parseKey(encoded, "public key")
+}
+
+// ParsePreSharedKey decodes base64 encoded 32-byte secret shared by both
+// sides of the connection
+func ParsePreSharedKey(encoded string) ([32]byte, error) {
+	return parseKey(encoded, "pre-shared key")
+}
+
+func parseKey(encoded string, kind string) (key [32]byte, err error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return key, err
+	}
+
+	if len(raw) != 32 {
+		return key, fmt.Errorf("invalid %s length: %d (expected 32 bytes)", kind, len(raw))
+	}
+
+	return [32]byte(raw), nil
+}
@@ -0,0 +1,506 @@
+package hsp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"time"
+)
+
+var ErrHostKeyMismatch = errors.New("server identity key doesn't match the expected one")
+
+var ErrHandshakeFailed = errors.New("peer failed to confirm the handshake")
+
+// Handshake establishes keys of a new connection, both sides have to use
+// the same kind of handshake
+type Handshake interface {
+	Server(conn net.Conn, config *ServerConfig) (*Connection, error)
+	Client(conn net.Conn, config *ClientConfig) (*Connection, error)
+}
+
+// LegacyHandshake is the original key exchange of ServerHandshake and
+// ClientHandshake, used when nothing else is configured
+var LegacyHandshake Handshake = legacyHandshake{}
+
+type legacyHandshake struct{}
+
+func (legacyHandshake) String() string {
+	return "legacy"
+}
+
+func (legacyHandshake) Server(conn net.Conn, config *ServerConfig) (*Connection, error) {
+	return ServerHandshake(conn, config)
+}
+
+func (legacyHandshake) Client(conn net.Conn, config *ClientConfig) (*Connection, error) {
+	return ClientHandshake(conn, config)
+}
+
+type ServerConfig struct {
+	// Long-term key identifying the server, mixed into every key exchange
+	Identity *KeyPair
+	// Accepted cipher suites in order of preference
+	CipherSuites []CipherSuite
+	// Secret mixed into the session keys, clients without it fail the handshake
+	PreSharedKey *[32]byte
+	// Issues session tickets to clients and resumes sessions with them,
+	// tickets are disabled if nil. Only the legacy handshake uses tickets.
+	Tickets *TicketKeys
+}
+
+type ClientConfig struct {
+	// Address of the server, used for looking up known hosts
+	Host string
+	// Server identity key the client expects, any other key is rejected
+	PinnedKey *[32]byte
+	// Trust on first use store of server identity keys
+	KnownHosts *KnownHosts
+	// Cipher suites offered to the server
+	CipherSuites []CipherSuite
+	// Long-term key identifying the client, anonymous if nil
+	Identity *KeyPair
+	// Secret mixed into the session keys, has to match the server's one
+	PreSharedKey *[32]byte
+	// Sessions resumed with tickets instead of full key exchange, tickets
+	// are disabled if nil
+	SessionCache ClientSessionCache
+}
+
+// Client sends its ephemeral public key, offered cipher suites and
+// optionally its identity public key and session ticket
+type clientHello struct {
+	Ephemeral [32]byte
+	Suites    []CipherSuite
+	Identity  *[32]byte
+	Ticket    []byte
+}
+
+func (h *clientHello) Marshal() []byte {
+	out := append(h.Ephemeral[:], byte(len(h.Suites)))
+	for _, suite := range h.Suites {
+		out = append(out, byte(suite))
+	}
+
+	if h.Identity == nil {
+		out = append(out, 0)
+	} else {
+		out = append(append(out, 1), h.Identity[:]...)
+	}
+
+	out = binary.BigEndian.AppendUint16(out, uint16(len(h.Ticket)))
+	return append(out, h.Ticket...)
+}
+
+func readClientHello(r io.Reader) (*clientHello, error) {
+	head := make([]byte, 33)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+
+	// Suites are followed by the identity flag
+	tail := make([]byte, int(head[32])+1)
+	if _, err := io.ReadFull(r, tail); err != nil {
+		return nil, err
+	}
+
+	hello := &clientHello{
+		Ephemeral: [32]byte(head[:32]),
+	}
+
+	for _, suite := range tail[:len(tail)-1] {
+		hello.Suites = append(hello.Suites, CipherSuite(suite))
+	}
+
+	switch tail[len(tail)-1] {
+	case 0:
+	case 1:
+		identity := [32]byte{}
+		if _, err := io.ReadFull(r, identity[:]); err != nil {
+			return nil, err
+		}
+		hello.Identity = &identity
+	default:
+		return nil, errors.New("invalid client identity flag")
+	}
+
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+
+	if n := binary.BigEndian.Uint16(size[:]); n > 0 {
+		hello.Ticket = make([]byte, n)
+		if _, err := io.ReadFull(r, hello.Ticket); err != nil {
+			return nil, err
+		}
+	}
+
+	return hello, nil
+}
+
+// Server replies with its ephemeral and identity public keys, the selected
+// cipher suite and whether client's ticket was accepted. Resuming server
+// sends random bytes instead of ephemeral key.
+type serverHello struct {
+	Ephemeral [32]byte
+	Identity  [32]byte
+	Suite     CipherSuite
+	Resumed   bool
+}
+
+func (h *serverHello) Marshal() []byte {
+	out := append(h.Ephemeral[:], h.Identity[:]...)
+	out = append(out, byte(h.Suite))
+	if h.Resumed {
+		return append(out, 1)
+	}
+	return append(out, 0)
+}
+
+func readServerHello(r io.Reader) (*serverHello, error) {
+	raw := make([]byte, 66)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, err
+	}
+
+	if raw[65] > 1 {
+		return nil, errors.New("invalid server resumption flag")
+	}
+
+	return &serverHello{
+		Ephemeral: [32]byte(raw[:32]),
+		Identity:  [32]byte(raw[32:64]),
+		Suite:     CipherSuite(raw[64]),
+		Resumed:   raw[65] == 1,
+	}, nil
+}
+
+func ServerHandshake(conn net.Conn, config *ServerConfig) (*Connection, error) {
+	if config == nil || config.Identity == nil {
+		return nil, errors.New("server identity key is not configured")
+	}
+
+	preferred := config.CipherSuites
+	if len(preferred) == 0 {
+		preferred = DefaultCipherSuites
+	}
+
+	ch, err := readClientHello(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	sh := &serverHello{
+		Identity: config.Identity.Public,
+		Suite:    SelectCipherSuite(preferred, ch.Suites),
+	}
+
+	if sh.Suite == SUITE_NONE {
+		_ = writeAll(conn, sh.Marshal())
+		return nil, ErrNoCommonSuite
+	}
+
+	// Unknown or expired tickets just fall back to the full key exchange
+	var ticket *ticketState
+	if len(ch.Ticket) > 0 && config.Tickets != nil {
+		ticket, _ = config.Tickets.open(ch.Ticket, time.Now())
+	}
+
+	var keys *KeyPair
+	var secret []byte
+	peer := ch.Identity
+
+	if ticket != nil {
+		if _, err := rand.Read(sh.Ephemeral[:]); err != nil {
+			return nil, err
+		}
+
+		sh.Resumed = true
+		secret = concat(ticket.Secret[:])
+		peer = ticket.Identity
+	} else {
+		keys, err = GenerateKeyPair()
+		if err != nil {
+			return nil, err
+		}
+
+		sh.Ephemeral = keys.Public
+
+		ephemeral, err := DeriveSharedKey(keys.Private, ch.Ephemeral)
+		if err != nil {
+			return nil, err
+		}
+
+		static, err := DeriveSharedKey(config.Identity.Private, ch.Ephemeral)
+		if err != nil {
+			return nil, err
+		}
+
+		secret = concat(ephemeral[:], static[:])
+
+		if ch.Identity != nil {
+			// Only the owner of client identity's private key is able to derive this one
+			client, err := DeriveSharedKey(keys.Private, *ch.Identity)
+			if err != nil {
+				return nil, err
+			}
+			secret = append(secret, client[:]...)
+		}
+	}
+
+	if config.PreSharedKey != nil {
+		secret = append(secret, config.PreSharedKey[:]...)
+	}
+
+	transcript := transcript(ch, sh)
+
+	session, err := DeriveSessionKeys(secret, transcript)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeAll(conn, concat(sh.Marshal(), finished(session.ServerConfirm, transcript))); err != nil {
+		return nil, err
+	}
+
+	clientFinished := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, clientFinished); err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal(clientFinished, finished(session.ClientConfirm, transcript)) {
+		return nil, ErrHandshakeFailed
+	}
+
+	connection := NewConnection(conn, keys, session.ServerToClient, session.ClientToServer)
+	connection.Suite = sh.Suite
+	connection.PeerIdentity = peer
+	connection.Resumed = sh.Resumed
+	connection.ClientRandom = ch.Ephemeral
+
+	if config.Tickets != nil {
+		issued, err := config.Tickets.seal(&ticketState{
+			Created:  time.Now(),
+			Secret:   session.Resumption,
+			Identity: peer,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// Sent along with the first packet, so it doesn't cost a round trip
+		lifetime := binary.BigEndian.AppendUint32(nil, uint32(config.Tickets.Lifetime/time.Second))
+		connection.ticket = concat(lifetime, issued)
+	}
+
+	return connection, nil
+}
+
+func ClientHandshake(conn net.Conn, config *ClientConfig) (*Connection, error) {
+	if config == nil {
+		config = &ClientConfig{}
+	}
+
+	offered := config.CipherSuites
+	if len(offered) == 0 {
+		offered = DefaultCipherSuites
+	}
+
+	keys, err := GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	ch := &clientHello{
+		Ephemeral: keys.Public,
+		Suites:    offered,
+	}
+
+	if config.Identity != nil {
+		ch.Identity = &config.Identity.Public
+	}
+
+	var resumable *ClientSession
+	if config.SessionCache != nil {
+		if cached, ok := config.SessionCache.Get(config.Host); ok {
+			// Tickets are used only once, server issues a new one
+			config.SessionCache.Put(config.Host, nil)
+			if time.Now().Before(cached.Expires) {
+				resumable = cached
+				ch.Ticket = cached.Ticket
+			}
+		}
+	}
+
+	if err := writeAll(conn, ch.Marshal()); err != nil {
+		return nil, err
+	}
+
+	sh, err := readServerHello(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if sh.Suite == SUITE_NONE {
+		return nil, ErrNoCommonSuite
+	}
+
+	if !slices.Contains(offered, sh.Suite) {
+		return nil, fmt.Errorf("server selected cipher suite that wasn't offered: %s", sh.Suite.String())
+	}
+
+	var secret []byte
+
+	if sh.Resumed {
+		if resumable == nil {
+			return nil, errors.New("server resumed session which wasn't offered")
+		}
+
+		if resumable.ServerIdentity != sh.Identity {
+			return nil, ErrHostKeyMismatch
+		}
+
+		secret = concat(resumable.Secret[:])
+	} else {
+		if err := verifyServerKey(config, sh.Identity); err != nil {
+			return nil, err
+		}
+
+		ephemeral, err := DeriveSharedKey(keys.Private, sh.Ephemeral)
+		if err != nil {
+			return nil, err
+		}
+
+		// Only the owner of identity's private key is able to derive this one
+		static, err := DeriveSharedKey(keys.Private, sh.Identity)
+		if err != nil {
+			return nil, err
+		}
+
+		secret = concat(ephemeral[:], static[:])
+
+		if config.Identity != nil {
+			client, err := DeriveSharedKey(config.Identity.Private, sh.Ephemeral)
+			if err != nil {
+				return nil, err
+			}
+			secret = append(secret, client[:]...)
+		}
+	}
+
+	if config.PreSharedKey != nil {
+		secret = append(secret, config.PreSharedKey[:]...)
+	}
+
+	transcript := transcript(ch, sh)
+
+	session, err := DeriveSessionKeys(secret, transcript)
+	if err != nil {
+		return nil, err
+	}
+
+	serverFinished := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, serverFinished); err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal(serverFinished, finished(session.ServerConfirm, transcript)) {
+		return nil, ErrHandshakeFailed
+	}
+
+	// Keys of unknown hosts are remembered only once the server proved them
+	if !sh.Resumed {
+		if err := rememberServerKey(config, sh.Identity); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writeAll(conn, finished(session.ClientConfirm, transcript)); err != nil {
+		return nil, err
+	}
+
+	connection := NewConnection(conn, keys, session.ClientToServer, session.ServerToClient)
+	connection.Suite = sh.Suite
+	connection.PeerIdentity = &sh.Identity
+	connection.Resumed = sh.Resumed
+	connection.ClientRandom = ch.Ephemeral
+	connection.client = true
+
+	if cache := config.SessionCache; cache != nil {
+		host := config.Host
+		connection.onTicket = func(ticket []byte, lifetime time.Duration) {
+			cache.Put(host, &ClientSession{
+				Ticket:         ticket,
+				Secret:         session.Resumption,
+				ServerIdentity: sh.Identity,
+				Expires:        time.Now().Add(lifetime),
+			})
+		}
+	}
+
+	return connection, nil
+}
+
+func verifyServerKey(config *ClientConfig, key [32]byte) error {
+	if config.PinnedKey != nil && *config.PinnedKey != key {
+		return ErrHostKeyMismatch
+	}
+
+	if config.KnownHosts != nil {
+		return config.KnownHosts.Verify(config.Host, key)
+	}
+
+	return nil
+}
+
+func rememberServerKey(config *ClientConfig, key [32]byte) error {
+	if config.KnownHosts != nil {
+		return config.KnownHosts.Remember(config.Host, key)
+	}
+
+	return nil
+}
+
+const transcriptLabel = "hsp handshake v7"
+
+// Transcript covers both hello messages, so neither keys nor offered
+// suites can be altered without both sides deriving different keys
+func transcript(ch *clientHello, sh *serverHello) []byte {
+	return concat([]byte(transcriptLabel), ch.Marshal(), sh.Marshal())
+}
+
+// finished proves that the sender derived the same keys from the same
+// transcript, which requires possession of its identity private key and
+// the pre-shared key if one is used
+func finished(key [32]byte, transcript []byte) []byte {
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write(transcript)
+	return mac.Sum(nil)
+}
+
+func writeAll(conn net.Conn, data []byte) error {
+	n, err := conn.Write(data)
+	if err != nil {
+		return err
+	}
+
+	if n != len(data) {
+		return fmt.Errorf("couldn't send %d bytes of handshake (%d sent instead)", len(data), n)
+	}
+
+	return nil
+}
+
+func concat(parts ...[]byte) []byte {
+	var out []byte
+	for _, part := range parts {
+		out = append(out, part...)
+	}
+	return out
+}
@@ -0,0 +1,234 @@
+package hsp
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func handshake(t *testing.T, server *ServerConfig, client *ClientConfig) (*Connection, *Connection, error) {
+	t.Helper()
+	return handshakeWith(t, LegacyHandshake, LegacyHandshake, server, client)
+}
+
+func handshakeWith(t *testing.T, serverKind, clientKind Handshake, server *ServerConfig, client *ClientConfig) (*Connection, *Connection, error) {
+	t.Helper()
+
+	left, right := net.Pipe()
+
+	type result struct {
+		conn *Connection
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		conn, err := serverKind.Server(right, server)
+		if err != nil {
+			right.Close()
+		}
+		done <- result{conn, err}
+	}()
+
+	clientConn, err := clientKind.Client(left, client)
+	if err != nil {
+		left.Close()
+		<-done
+		return nil, nil, err
+	}
+
+	res := <-done
+	return res.conn, clientConn, res.err
+}
+
+func TestHandshakePinnedKey(t *testing.T) {
+	identity, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate identity:", err)
+	}
+
+	server, client, err := handshake(t, &ServerConfig{Identity: identity}, &ClientConfig{PinnedKey: &identity.Public})
+	if err != nil {
+		t.Fatal("ERR: Handshake with pinned key failed:", err)
+	}
+
+	if server.SendKey != client.RecvKey || server.RecvKey != client.SendKey {
+		t.Error("Server and client derived different keys")
+	}
+
+	if server.SendKey == server.RecvKey {
+		t.Error("Both directions use the same key")
+	}
+
+	other, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate identity:", err)
+	}
+
+	_, _, err = handshake(t, &ServerConfig{Identity: other}, &ClientConfig{PinnedKey: &identity.Public})
+	if !errors.Is(err, ErrHostKeyMismatch) {
+		t.Error("Expected host key mismatch, got:", err)
+	}
+}
+
+func TestHandshakeKnownHosts(t *testing.T) {
+	knownHosts := NewKnownHosts(filepath.Join(t.TempDir(), "known_hosts"))
+
+	identity, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate identity:", err)
+	}
+
+	config := &ClientConfig{Host: "localhost:998", KnownHosts: knownHosts}
+
+	if _, _, err := handshake(t, &ServerConfig{Identity: identity}, config); err != nil {
+		t.Fatal("ERR: First handshake failed:", err)
+	}
+
+	key, found, err := knownHosts.Lookup("localhost:998")
+	if err != nil || !found || key != identity.Public {
+		t.Fatal("Server key wasn't remembered on first use:", err)
+	}
+
+	impostor, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate identity:", err)
+	}
+
+	_, _, err = handshake(t, &ServerConfig{Identity: impostor}, config)
+	if !errors.Is(err, ErrHostKeyMismatch) {
+		t.Error("Expected host key mismatch, got:", err)
+	}
+}
+
+func TestHandshakeKnownHostsAfterFinished(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	knownHosts := NewKnownHosts(path)
+
+	identity, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate identity:", err)
+	}
+
+	psk := [32]byte{1}
+	config := &ClientConfig{Host: "localhost:998", KnownHosts: knownHosts, PreSharedKey: &psk}
+
+	// Server's Finished doesn't match, so it didn't prove the key
+	_, _, err = handshake(t, &ServerConfig{Identity: identity, PreSharedKey: &[32]byte{2}}, config)
+	if !errors.Is(err, ErrHandshakeFailed) {
+		t.Fatal("Expected handshake to fail, got:", err)
+	}
+
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("Key of failed handshake was written:", err)
+	}
+
+	if _, _, err := handshake(t, &ServerConfig{Identity: identity, PreSharedKey: &psk}, config); err != nil {
+		t.Fatal("ERR: Handshake failed:", err)
+	}
+
+	key, found, err := knownHosts.Lookup("localhost:998")
+	if err != nil || !found || key != identity.Public {
+		t.Error("Server key wasn't remembered after handshake:", err)
+	}
+}
+
+func TestHandshakeCipherSuites(t *testing.T) {
+	identity, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate identity:", err)
+	}
+
+	server, client, err := handshake(t,
+		&ServerConfig{Identity: identity, CipherSuites: []CipherSuite{SUITE_AES_256_GCM, SUITE_CHACHA20_POLY1305}},
+		&ClientConfig{CipherSuites: []CipherSuite{SUITE_CHACHA20_POLY1305}},
+	)
+	if err != nil {
+		t.Fatal("ERR: Handshake failed:", err)
+	}
+
+	if server.Suite != SUITE_CHACHA20_POLY1305 || client.Suite != SUITE_CHACHA20_POLY1305 {
+		t.Errorf("Expected %s to be selected, got %s and %s", SUITE_CHACHA20_POLY1305, server.Suite, client.Suite)
+	}
+
+	_, _, err = handshake(t,
+		&ServerConfig{Identity: identity, CipherSuites: []CipherSuite{SUITE_AES_256_GCM}},
+		&ClientConfig{CipherSuites: []CipherSuite{SUITE_CHACHA20_POLY1305}},
+	)
+	if !errors.Is(err, ErrNoCommonSuite) {
+		t.Error("Expected no common suite, got:", err)
+	}
+}
+
+func TestHandshakeClientIdentity(t *testing.T) {
+	identity, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate identity:", err)
+	}
+
+	clientIdentity, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate client identity:", err)
+	}
+
+	server, _, err := handshake(t, &ServerConfig{Identity: identity}, &ClientConfig{Identity: clientIdentity})
+	if err != nil {
+		t.Fatal("ERR: Handshake with client identity failed:", err)
+	}
+
+	if server.PeerIdentity == nil || *server.PeerIdentity != clientIdentity.Public {
+		t.Error("Server didn't expose the client identity")
+	}
+
+	server, _, err = handshake(t, &ServerConfig{Identity: identity}, &ClientConfig{})
+	if err != nil {
+		t.Fatal("ERR: Anonymous handshake failed:", err)
+	}
+
+	if server.PeerIdentity != nil {
+		t.Error("Anonymous client has an identity")
+	}
+
+	// Presenting someone else's public key without its private key
+	impostor, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate identity:", err)
+	}
+	impostor.Public = clientIdentity.Public
+
+	_, _, err = handshake(t, &ServerConfig{Identity: identity}, &ClientConfig{Identity: impostor})
+	if !errors.Is(err, ErrHandshakeFailed) {
+		t.Error("Expected failed handshake, got:", err)
+	}
+}
+
+func TestHandshakePreSharedKey(t *testing.T) {
+	identity, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate identity:", err)
+	}
+
+	psk := [32]byte{1, 2, 3}
+	other := [32]byte{3, 2, 1}
+
+	server, client, err := handshake(t, &ServerConfig{Identity: identity, PreSharedKey: &psk}, &ClientConfig{PreSharedKey: &psk})
+	if err != nil {
+		t.Fatal("ERR: Handshake with pre-shared key failed:", err)
+	}
+
+	if server.SendKey != client.RecvKey {
+		t.Error("Server and client derived different keys")
+	}
+
+	_, _, err = handshake(t, &ServerConfig{Identity: identity, PreSharedKey: &psk}, &ClientConfig{PreSharedKey: &other})
+	if !errors.Is(err, ErrHandshakeFailed) {
+		t.Error("Expected failed handshake with wrong key, got:", err)
+	}
+
+	_, _, err = handshake(t, &ServerConfig{Identity: identity, PreSharedKey: &psk}, &ClientConfig{})
+	if !errors.Is(err, ErrHandshakeFailed) {
+		t.Error("Expected failed handshake without key, got:", err)
+	}
+}
@@ -0,0 +1,302 @@
+package hsp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Header block is a list of `key:value` lines terminated with an empty line.
+// Keys are lowercase tokens, values are escaped with EscapeHeader.
+
+const (
+	MaxHeaderCount     = 128
+	MaxHeaderKeyLength = 256
+	// Length of unescaped value
+	MaxHeaderValueLength = 8 << 10
+	// Size of the whole serialized header block
+	MaxHeaderBytes = 32 << 10
+)
+
+var ErrMalformedHeaders = errors.New("malformed headers")
+
+func headerError(line int, format string, args ...any) error {
+	return fmt.Errorf("%w: line %d: %s", ErrMalformedHeaders, line, fmt.Sprintf(format, args...))
+}
+
+// Header maps keys to their values in order the values were added. Keys are
+// case-insensitive and kept in canonical lowercase form.
+type Header map[string][]string
+
+func CanonicalHeaderKey(key string) string {
+	return strings.ToLower(key)
+}
+
+// Add appends value to the values of the key
+func (h Header) Add(key, value string) {
+	key = CanonicalHeaderKey(key)
+	h[key] = append(h[key], value)
+}
+
+// Set replaces all values of the key with a single value
+func (h Header) Set(key, value string) {
+	h[CanonicalHeaderKey(key)] = []string{value}
+}
+
+// Get returns the first value of the key, empty string if there is none
+func (h Header) Get(key string) string {
+	if values := h[CanonicalHeaderKey(key)]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (h Header) Has(key string) bool {
+	return len(h[CanonicalHeaderKey(key)]) > 0
+}
+
+func (h Header) Values(key string) []string {
+	return h[CanonicalHeaderKey(key)]
+}
+
+func (h Header) Del(key string) {
+	delete(h, CanonicalHeaderKey(key))
+}
+
+func (h Header) Clone() Header {
+	if h == nil {
+		return nil
+	}
+
+	clone := make(Header, len(h))
+	for key, values := range h {
+		clone[key] = slices.Clone(values)
+	}
+	return clone
+}
+
+// Keys in sorted order, which is also the order of serialization
+func (h Header) Keys() []string {
+	return slices.Sorted(maps.Keys(h))
+}
+
+// ParseHeaders adds parsed headers to the given ones, nil headers are
+// allocated. Keys repeated on several lines get multiple values.
+func ParseHeaders(rawHeaders []byte, headers *Header) error {
+	if *headers == nil {
+		*headers = make(Header)
+	}
+
+	if len(rawHeaders) > MaxHeaderBytes {
+		return fmt.Errorf("%w: headers are larger than %d bytes", ErrMalformedHeaders, MaxHeaderBytes)
+	}
+
+	rest := rawHeaders
+	for line := 1; ; line++ {
+		end := bytes.IndexByte(rest, '\n')
+		if end < 0 {
+			if len(rest) == 0 && line == 1 {
+				// Nothing at all is the same as no headers
+				return nil
+			}
+			return headerError(line, "missing line terminator")
+		}
+
+		if end == 0 {
+			if len(rest) > 1 {
+				return headerError(line, "%d bytes after the end of headers", len(rest)-1)
+			}
+			return nil
+		}
+
+		if line > MaxHeaderCount {
+			return headerError(line, "more than %d headers", MaxHeaderCount)
+		}
+
+		colon := bytes.IndexByte(rest[:end], ':')
+		if colon < 0 {
+			return headerError(line, "missing ':' separator")
+		}
+
+		rawKey := rest[:colon]
+		if err := validateHeaderKey(rawKey); err != nil {
+			return headerError(line, "%s", err.Error())
+		}
+
+		value, err := UnescapeHeader(string(rest[colon+1 : end]))
+		if err != nil {
+			return headerError(line, "%s", err.Error())
+		}
+
+		if len(value) > MaxHeaderValueLength {
+			return headerError(line, "header value is longer than %d bytes", MaxHeaderValueLength)
+		}
+
+		(*headers).Add(string(rawKey), value)
+		rest = rest[end+1:]
+	}
+}
+
+// SerializeHeaders writes every value on its own line, keys are sorted so
+// the same headers always produce the same bytes
+func SerializeHeaders(headers Header) []byte {
+	buf := new(bytes.Buffer)
+	for _, key := range headers.Keys() {
+		for _, value := range headers[key] {
+			buf.WriteString(key)
+			buf.WriteByte(':')
+			buf.WriteString(EscapeHeader(value))
+			buf.WriteByte('\n')
+		}
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// ValidateHeaders checks that headers can be sent and will be accepted by
+// ParseHeaders on the other side
+func ValidateHeaders(headers Header) error {
+	count := 0
+	// Terminating empty line
+	size := 1
+	for key, values := range headers {
+		if err := validateHeaderKey([]byte(key)); err != nil {
+			return fmt.Errorf("%w: %s", ErrMalformedHeaders, err.Error())
+		}
+
+		if key != CanonicalHeaderKey(key) {
+			return fmt.Errorf("%w: header key %q is not canonical", ErrMalformedHeaders, key)
+		}
+
+		for _, value := range values {
+			if len(value) > MaxHeaderValueLength {
+				return fmt.Errorf("%w: value of header %q is longer than %d bytes", ErrMalformedHeaders, key, MaxHeaderValueLength)
+			}
+			size += len(key) + len(EscapeHeader(value)) + 2
+		}
+
+		count += len(values)
+	}
+
+	if count > MaxHeaderCount {
+		return fmt.Errorf("%w: more than %d headers", ErrMalformedHeaders, MaxHeaderCount)
+	}
+
+	if size > MaxHeaderBytes {
+		return fmt.Errorf("%w: headers are larger than %d bytes", ErrMalformedHeaders, MaxHeaderBytes)
+	}
+
+	return nil
+}
+
+func validateHeaderKey(key []byte) error {
+	if len(key) == 0 {
+		return errors.New("empty header key")
+	}
+
+	if len(key) > MaxHeaderKeyLength {
+		return fmt.Errorf("header key is longer than %d bytes", MaxHeaderKeyLength)
+	}
+
+	for _, c := range key {
+		if !isTokenChar(c) {
+			return fmt.Errorf("invalid character %q in header key %q", c, key)
+		}
+	}
+
+	return nil
+}
+
+// Same characters as HTTP allows in header names
+func isTokenChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// EscapeHeader percent-encodes bytes which would break header framing, the
+// rest of the value, including any UTF-8, is kept as is
+func EscapeHeader(value string) string {
+	const hex = "0123456789ABCDEF"
+
+	var buf []byte
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if needsEscape(c) {
+			if buf == nil {
+				buf = append(make([]byte, 0, len(value)+8), value[:i]...)
+			}
+			buf = append(buf, '%', hex[c>>4], hex[c&0x0f])
+		} else if buf != nil {
+			buf = append(buf, c)
+		}
+	}
+
+	if buf == nil {
+		return value
+	}
+	return string(buf)
+}
+
+// needsEscape reports whether EscapeHeader encodes the byte
+func needsEscape(c byte) bool {
+	return c < 0x20 || c == 0x7f || c == '%'
+}
+
+// UnescapeHeader decodes value escaped with EscapeHeader. Bytes which
+// EscapeHeader would have encoded are rejected, so values grow back only
+// to the size they were received with.
+func UnescapeHeader(value string) (string, error) {
+	escaped := false
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; c == '%' {
+			escaped = true
+		} else if needsEscape(c) {
+			return "", fmt.Errorf("unescaped byte 0x%02X in header", c)
+		}
+	}
+
+	if !escaped {
+		return value, nil
+	}
+
+	buf := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
+		if value[i] != '%' {
+			buf = append(buf, value[i])
+			continue
+		}
+
+		if i+2 >= len(value) {
+			return "", fmt.Errorf("truncated escape sequence in header: %q", value)
+		}
+
+		hi, ok1 := unhex(value[i+1])
+		lo, ok2 := unhex(value[i+2])
+		if !ok1 || !ok2 {
+			return "", fmt.Errorf("invalid escape sequence in header: %q", value[i:i+3])
+		}
+
+		buf = append(buf, hi<<4|lo)
+		i += 2
+	}
+
+	return string(buf), nil
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
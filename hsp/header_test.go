@@ -0,0 +1,195 @@
+package hsp
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestHeadersRoundTrip(t *testing.T) {
+	headers := Header{}
+	for key, value := range map[string]string{
+		"timestamp": "2024-05-01 12:30:00",
+		"json":      `{"a": [1, 2], "b": "c:d"}`,
+		"base64":    "aGVsbG8gd29ybGQ=",
+		"ipv6":      "[::1]:998",
+		"multiline": "first\nsecond\r\nthird",
+		"percent":   "100% %41",
+		"utf-8":     "привет, 世界",
+		"binary":    string([]byte{0, 1, 0xff, '\n', 0x7f, 0xc3}),
+		"spaced":    " spaced value ",
+		"empty":     "",
+	} {
+		headers.Set(key, value)
+	}
+	headers.Add("via", "first")
+	headers.Add("via", "second")
+
+	// Nil headers are allocated by the parser
+	var parsed Header
+	if err := ParseHeaders(SerializeHeaders(headers), &parsed); err != nil {
+		t.Fatal("ERR: Failed to parse headers:", err)
+	}
+
+	if len(parsed) != len(headers) {
+		t.Errorf("Expected %d headers, got %d", len(headers), len(parsed))
+	}
+
+	for key, values := range headers {
+		if !slices.Equal(parsed[key], values) {
+			t.Errorf("Header %q changed: %q -> %q", key, values, parsed[key])
+		}
+	}
+}
+
+func TestHeaderCanonicalKeys(t *testing.T) {
+	headers := make(Header)
+	headers.Add("X-Trace", "a")
+	headers.Add("x-trace", "b")
+
+	if got := headers.Values("X-TRACE"); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("Unexpected values: %q", got)
+	}
+
+	if got := headers.Get("x-Trace"); got != "a" {
+		t.Errorf("Get returned %q instead of first value", got)
+	}
+
+	headers.Set("X-Trace", "c")
+	if got := headers.Values("x-trace"); !slices.Equal(got, []string{"c"}) {
+		t.Errorf("Set didn't replace values: %q", got)
+	}
+
+	headers.Del("X-TRACE")
+	if headers.Has("x-trace") || len(headers) != 0 {
+		t.Error("Header wasn't deleted")
+	}
+}
+
+func TestSerializeHeadersOrder(t *testing.T) {
+	headers := make(Header)
+	headers.Add("route", "/a")
+	headers.Add("auth", "token")
+	headers.Add("x-tag", "2")
+	headers.Add("x-tag", "1")
+
+	expected := "auth:token\nroute:/a\nx-tag:2\nx-tag:1\n\n"
+	for range 10 {
+		if raw := string(SerializeHeaders(headers)); raw != expected {
+			t.Fatalf("Unexpected serialization %q", raw)
+		}
+	}
+}
+
+func TestUnescapeHeader(t *testing.T) {
+	for _, value := range []string{"%", "%4", "%zz", "abc%0", "a\x00", "a\tb", "\x7f%25"} {
+		if _, err := UnescapeHeader(value); err == nil {
+			t.Errorf("Invalid escape %q was accepted", value)
+		}
+	}
+
+	if value, err := UnescapeHeader("a%3Ab%0a"); err != nil || value != "a:b\n" {
+		t.Errorf("Unexpected unescaped value %q: %v", value, err)
+	}
+}
+
+func TestParseMalformedHeaders(t *testing.T) {
+	var tooMany strings.Builder
+	for i := range MaxHeaderCount + 1 {
+		fmt.Fprintf(&tooMany, "h%d:v\n", i)
+	}
+
+	for name, raw := range map[string]string{
+		"no separator":    "route\n\n",
+		"no terminator":   "route:/a",
+		"empty key":       ":value\n\n",
+		"invalid key":     "ro ute:/a\n\n",
+		"trailing data":   "route:/a\n\nmore",
+		"invalid escape":  "route:%zz\n\n",
+		"long key":        strings.Repeat("k", MaxHeaderKeyLength+1) + ":v\n\n",
+		"too many":        tooMany.String() + "\n",
+		"only terminator": "\n\n",
+		"long value":      "v:" + strings.Repeat("a", MaxHeaderValueLength+1) + "\n\n",
+		// Escaped value is longer than the limit, but unescaped fits it
+		"too large": strings.Repeat("v:"+strings.Repeat("%00", MaxHeaderValueLength/2)+"\n", 3) + "\n",
+	} {
+		var headers Header
+		err := ParseHeaders([]byte(raw), &headers)
+		if !errors.Is(err, ErrMalformedHeaders) {
+			t.Errorf("%s: expected malformed headers, got: %v", name, err)
+		}
+	}
+}
+
+func TestValidateHeaders(t *testing.T) {
+	if err := ValidateHeaders(Header{"x-stream": {"1:2"}, "data-format": {"text"}}); err != nil {
+		t.Error("Valid headers were rejected:", err)
+	}
+
+	if err := ValidateHeaders(Header{"bad\nkey": {""}}); !errors.Is(err, ErrMalformedHeaders) {
+		t.Error("Invalid key was accepted:", err)
+	}
+
+	if err := ValidateHeaders(Header{"Route": {"/a"}}); !errors.Is(err, ErrMalformedHeaders) {
+		t.Error("Non-canonical key was accepted:", err)
+	}
+
+	// Keys are tokens since version 8, they are not escaped
+	for _, key := range []string{"key:with\n", " spaced key"} {
+		if err := ValidateHeaders(Header{key: {"value"}}); !errors.Is(err, ErrMalformedHeaders) {
+			t.Errorf("Key %q was accepted: %v", key, err)
+		}
+	}
+
+	if err := ValidateHeaders(Header{"v": {strings.Repeat("a", MaxHeaderValueLength)}}); err != nil {
+		t.Error("Value of maximum length was rejected:", err)
+	}
+
+	if err := ValidateHeaders(Header{"v": {strings.Repeat("a", MaxHeaderValueLength+1)}}); !errors.Is(err, ErrMalformedHeaders) {
+		t.Error("Too long value was accepted:", err)
+	}
+
+	// Fits the limit only before escaping
+	zeros := strings.Repeat("\x00", MaxHeaderValueLength/2)
+	large := Header{"v": {zeros, zeros, zeros}}
+	if err := ValidateHeaders(large); !errors.Is(err, ErrMalformedHeaders) {
+		t.Error("Too large headers were accepted:", err)
+	}
+
+	var parsed Header
+	if err := ParseHeaders(SerializeHeaders(Header{"v": {strings.Repeat("a", MaxHeaderValueLength)}}), &parsed); err != nil {
+		t.Error("Value of maximum length wasn't parsed:", err)
+	}
+}
+
+func FuzzParseHeaders(f *testing.F) {
+	f.Add([]byte("\n"))
+	f.Add([]byte("route:/a\ndata-format:text:utf-8\n\n"))
+	f.Add([]byte("route\n"))
+	f.Add([]byte("a:%0A%25\n\n"))
+	f.Add([]byte("a:b"))
+	f.Add([]byte(strings.Repeat("a:"+strings.Repeat("\x7f", 8000)+"\n", 4) + "\n"))
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		headers := make(Header)
+		if err := ParseHeaders(raw, &headers); err != nil {
+			return
+		}
+
+		if err := ValidateHeaders(headers); err != nil {
+			t.Fatal("Parsed headers are invalid:", err)
+		}
+
+		again := make(Header)
+		if err := ParseHeaders(SerializeHeaders(headers), &again); err != nil {
+			t.Fatal("Serialized headers can't be parsed:", err)
+		}
+
+		if !maps.EqualFunc(headers, again, slices.Equal) {
+			t.Fatalf("Headers changed after round trip: %q -> %q", headers, again)
+		}
+	})
+}
@@ -0,0 +1,159 @@
+package hsp
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	PEM_PRIVATE_KEY = "HSP PRIVATE KEY"
+	PEM_PUBLIC_KEY  = "HSP PUBLIC KEY"
+)
+
+var ErrInvalidKeyFile = errors.New("invalid key file")
+
+// Fingerprint is a short form of public key for displaying and comparing
+// by people, in the same format as ssh uses
+func Fingerprint(key [32]byte) string {
+	sum := sha256.Sum256(key[:])
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// EncodeKeyPair writes the private key in PEM format, public key is derived
+// from it on decoding
+func EncodeKeyPair(pair *KeyPair) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type: PEM_PRIVATE_KEY,
+		Headers: map[string]string{
+			"Fingerprint": Fingerprint(pair.Public),
+		},
+		Bytes: pair.Private[:],
+	})
+}
+
+func DecodeKeyPair(data []byte) (*KeyPair, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != PEM_PRIVATE_KEY {
+		return nil, fmt.Errorf("%w: no %s block found", ErrInvalidKeyFile, PEM_PRIVATE_KEY)
+	}
+
+	return keyPairFromPrivate(block.Bytes)
+}
+
+func keyPairFromPrivate(private []byte) (*KeyPair, error) {
+	if len(private) != 32 {
+		return nil, fmt.Errorf("%w: invalid private key length: %d (expected 32 bytes)", ErrInvalidKeyFile, len(private))
+	}
+
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewKeyPair([32]byte(public), [32]byte(private)), nil
+}
+
+func EncodePublicKeyPEM(key [32]byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type: PEM_PUBLIC_KEY,
+		Headers: map[string]string{
+			"Fingerprint": Fingerprint(key),
+		},
+		Bytes: key[:],
+	})
+}
+
+// DecodePublicKeyPEM reads public key, private key files are accepted as
+// well and their public key is returned
+func DecodePublicKeyPEM(data []byte) (key [32]byte, err error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return key, fmt.Errorf("%w: no PEM block found", ErrInvalidKeyFile)
+	}
+
+	switch block.Type {
+	case PEM_PUBLIC_KEY:
+		if len(block.Bytes) != 32 {
+			return key, fmt.Errorf("%w: invalid public key length: %d (expected 32 bytes)", ErrInvalidKeyFile, len(block.Bytes))
+		}
+		return [32]byte(block.Bytes), nil
+	case PEM_PRIVATE_KEY:
+		pair, err := keyPairFromPrivate(block.Bytes)
+		if err != nil {
+			return key, err
+		}
+		return pair.Public, nil
+	default:
+		return key, fmt.Errorf("%w: unexpected block type %s", ErrInvalidKeyFile, block.Type)
+	}
+}
+
+func LoadKeyPair(path string) (*KeyPair, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pair, err := DecodeKeyPair(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return pair, nil
+}
+
+// SaveKeyPair replaces the file atomically, so rotated identity is never
+// seen half-written. The file is readable only by the owner.
+func SaveKeyPair(path string, pair *KeyPair) error {
+	return writeKeyFile(path, EncodeKeyPair(pair), 0o600)
+}
+
+func LoadPublicKey(path string) ([32]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return [32]byte{}, err
+	}
+
+	key, err := DecodePublicKeyPEM(data)
+	if err != nil {
+		return key, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return key, nil
+}
+
+func SavePublicKey(path string, key [32]byte) error {
+	return writeKeyFile(path, EncodePublicKeyPEM(key), 0o644)
+}
+
+func writeKeyFile(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
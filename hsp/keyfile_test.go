@@ -0,0 +1,63 @@
+package hsp
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyFiles(t *testing.T) {
+	pair, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate key pair:", err)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "identity")
+
+	if err := SaveKeyPair(path, pair); err != nil {
+		t.Fatal("ERR: Failed to save key pair:", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal("ERR: Failed to stat key file:", err)
+	}
+
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("Private key file is accessible by others: %v", info.Mode().Perm())
+	}
+
+	loaded, err := LoadKeyPair(path)
+	if err != nil {
+		t.Fatal("ERR: Failed to load key pair:", err)
+	}
+
+	if *loaded != *pair {
+		t.Error("Loaded key pair differs from the saved one")
+	}
+
+	if err := SavePublicKey(path+".pub", pair.Public); err != nil {
+		t.Fatal("ERR: Failed to save public key:", err)
+	}
+
+	for _, file := range []string{path + ".pub", path} {
+		public, err := LoadPublicKey(file)
+		if err != nil {
+			t.Fatal("ERR: Failed to load public key:", err)
+		}
+
+		if public != pair.Public {
+			t.Errorf("Public key loaded from %s differs from the saved one", file)
+		}
+	}
+
+	if _, err := DecodeKeyPair(EncodePublicKeyPEM(pair.Public)); !errors.Is(err, ErrInvalidKeyFile) {
+		t.Error("Public key was accepted as key pair:", err)
+	}
+
+	if Fingerprint(pair.Public) == Fingerprint(loaded.Private) {
+		t.Error("Different keys have the same fingerprint")
+	}
+}
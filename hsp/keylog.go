@@ -0,0 +1,121 @@
+package hsp
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Key log lines follow the SSLKEYLOGFILE format: label, client random and
+// the secret, all separated with spaces. Client random is client's
+// ephemeral public key, which is sent in clear at the start of handshake.
+const (
+	KEYLOG_CLIENT_KEY   = "CLIENT_TRAFFIC_KEY"
+	KEYLOG_SERVER_KEY   = "SERVER_TRAFFIC_KEY"
+	KEYLOG_CIPHER_SUITE = "CIPHER_SUITE"
+)
+
+// KeyLogEntry holds keys of one connection as they were right after the
+// handshake, before any rekeying
+type KeyLogEntry struct {
+	ClientRandom [32]byte
+	ClientKey    [32]byte
+	ServerKey    [32]byte
+	Suite        CipherSuite
+}
+
+// LogKeys appends current keys of the connection to the key log, so the
+// traffic can be decrypted later. It has to be called before any packets
+// are exchanged. Lines are written at once, so the log can be shared
+// between connections.
+func (c *Connection) LogKeys(w io.Writer) error {
+	clientKey, serverKey := c.SendKey, c.RecvKey
+	if !c.client {
+		clientKey, serverKey = serverKey, clientKey
+	}
+
+	random := hex.EncodeToString(c.ClientRandom[:])
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %s\n", KEYLOG_CLIENT_KEY, random, hex.EncodeToString(clientKey[:]))
+	fmt.Fprintf(&b, "%s %s %s\n", KEYLOG_SERVER_KEY, random, hex.EncodeToString(serverKey[:]))
+	fmt.Fprintf(&b, "%s %s %s\n", KEYLOG_CIPHER_SUITE, random, c.Suite.String())
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// ResyncSequence makes the connection expect packet with sequence number seq
+// next, as if the packets before it were received. It defeats replay
+// protection, so it's meant only for decoding captures with missing packets.
+func (c *Connection) ResyncSequence(seq uint64) {
+	c.recvSeq = seq
+}
+
+// ReadKeyLog parses key log, entries are returned in order of appearance.
+// Unknown labels are skipped, so the file can be shared with other tools.
+func ReadKeyLog(r io.Reader) ([]*KeyLogEntry, error) {
+	var entries []*KeyLogEntry
+	byRandom := make(map[[32]byte]*KeyLogEntry)
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: invalid key log entry", line)
+		}
+
+		switch fields[0] {
+		case KEYLOG_CLIENT_KEY, KEYLOG_SERVER_KEY, KEYLOG_CIPHER_SUITE:
+		default:
+			continue
+		}
+
+		random, err := decodeKeyLogHex(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid client random: %s", line, err.Error())
+		}
+
+		entry, ok := byRandom[random]
+		if !ok {
+			entry = &KeyLogEntry{ClientRandom: random}
+			byRandom[random] = entry
+			entries = append(entries, entry)
+		}
+
+		switch fields[0] {
+		case KEYLOG_CLIENT_KEY:
+			entry.ClientKey, err = decodeKeyLogHex(fields[2])
+		case KEYLOG_SERVER_KEY:
+			entry.ServerKey, err = decodeKeyLogHex(fields[2])
+		case KEYLOG_CIPHER_SUITE:
+			entry.Suite, err = ParseCipherSuite(fields[2])
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err.Error())
+		}
+	}
+
+	return entries, scanner.Err()
+}
+
+func decodeKeyLogHex(encoded string) (key [32]byte, err error) {
+	raw, err := hex.DecodeString(encoded)
+	if err != nil {
+		return key, err
+	}
+
+	if len(raw) != 32 {
+		return key, fmt.Errorf("invalid length: %d (expected 32 bytes)", len(raw))
+	}
+
+	return [32]byte(raw), nil
+}
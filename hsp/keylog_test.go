@@ -0,0 +1,45 @@
+package hsp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeyLog(t *testing.T) {
+	identity, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate identity:", err)
+	}
+
+	server, client, err := handshake(t, &ServerConfig{Identity: identity}, &ClientConfig{})
+	if err != nil {
+		t.Fatal("ERR: Handshake failed:", err)
+	}
+
+	var log bytes.Buffer
+	if err := server.LogKeys(&log); err != nil {
+		t.Fatal("ERR: Failed to log server keys:", err)
+	}
+	if err := client.LogKeys(&log); err != nil {
+		t.Fatal("ERR: Failed to log client keys:", err)
+	}
+
+	entries, err := ReadKeyLog(&log)
+	if err != nil {
+		t.Fatal("ERR: Failed to read key log:", err)
+	}
+
+	// Both sides describe the same connection
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(entries))
+	}
+
+	entry := entries[0]
+	if entry.ClientRandom != client.ClientRandom || entry.ClientKey != client.SendKey || entry.ServerKey != client.RecvKey {
+		t.Error("Logged keys don't match the connection")
+	}
+
+	if entry.Suite != client.Suite {
+		t.Errorf("Expected %s suite, got %s", client.Suite, entry.Suite)
+	}
+}
@@ -0,0 +1,136 @@
+package hsp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// KnownHosts is a trust on first use store of server identity keys. Each
+// line of the file contains address of the server and its encoded key
+// separated with space, lines starting with # are ignored.
+type KnownHosts struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func NewKnownHosts(path string) *KnownHosts {
+	return &KnownHosts{
+		Path: path,
+	}
+}
+
+func (k *KnownHosts) Lookup(host string) (key [32]byte, found bool, err error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.lookup(host)
+}
+
+func (k *KnownHosts) lookup(host string) (key [32]byte, found bool, err error) {
+	file, err := os.Open(k.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return key, false, nil
+	}
+	if err != nil {
+		return key, false, err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return key, false, fmt.Errorf("%s:%d: invalid known host entry", k.Path, line)
+		}
+
+		if fields[0] != host {
+			continue
+		}
+
+		key, err = ParsePublicKey(fields[1])
+		if err != nil {
+			return key, false, fmt.Errorf("%s:%d: %s", k.Path, line, err.Error())
+		}
+
+		return key, true, nil
+	}
+
+	return key, false, scanner.Err()
+}
+
+func (k *KnownHosts) Add(host string, key [32]byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.add(host, key)
+}
+
+func (k *KnownHosts) add(host string, key [32]byte) error {
+	file, err := os.OpenFile(k.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(file, "%s %s\n", host, EncodePublicKey(key)); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// Verify checks the key against the one remembered for the host, keys of
+// unknown hosts pass. The file is not modified, so the key can be checked
+// before the server proves it owns it.
+func (k *KnownHosts) Verify(host string, key [32]byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	known, found, err := k.lookup(host)
+	if err != nil {
+		return err
+	}
+
+	if found && known != key {
+		return mismatch(host, key)
+	}
+
+	return nil
+}
+
+// Remember stores key of a host seen for the first time, it should be
+// called only after the server proved possession of the key
+func (k *KnownHosts) Remember(host string, key [32]byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	known, found, err := k.lookup(host)
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return k.add(host, key)
+	}
+
+	// Other connection might have remembered a different key meanwhile
+	if known != key {
+		return mismatch(host, key)
+	}
+
+	return nil
+}
+
+func mismatch(host string, key [32]byte) error {
+	return fmt.Errorf("%w: %s presented %s", ErrHostKeyMismatch, host, EncodePublicKey(key))
+}
@@ -0,0 +1,644 @@
+package hsp
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Implementation of Noise protocol framework handshakes (revision 34) with
+// Curve25519 and SHA256. Only handshake messages follow the framework, the
+// transport keys produced by Split are used by Connection as usual.
+
+var ErrUnknownServerKey = errors.New("server identity key has to be known in advance")
+
+var ErrPatternMismatch = errors.New("peer uses another handshake pattern")
+
+type noiseToken uint8
+
+const (
+	tokenE noiseToken = iota
+	tokenS
+	tokenEE
+	tokenES
+	tokenSE
+	tokenSS
+)
+
+type noisePattern struct {
+	ID   uint8
+	Name string
+	// Responder's static key is known to the initiator before handshake
+	PreResponderStatic bool
+	// Messages alternate between initiator and responder, starting with
+	// the initiator
+	Messages [][]noiseToken
+	// Index of the message ending with psk token in psk mode. It is always
+	// initiator's message, so the server refuses wrong key before the
+	// handshake completes.
+	PSKMessage int
+}
+
+var noiseXX = &noisePattern{
+	ID:   1,
+	Name: "XX",
+	Messages: [][]noiseToken{
+		{tokenE},
+		{tokenE, tokenEE, tokenS, tokenES},
+		{tokenS, tokenSE},
+	},
+	PSKMessage: 2,
+}
+
+var noiseIK = &noisePattern{
+	ID:                 2,
+	Name:               "IK",
+	PreResponderStatic: true,
+	Messages: [][]noiseToken{
+		{tokenE, tokenES, tokenS, tokenSS},
+		{tokenE, tokenEE, tokenSE},
+	},
+	PSKMessage: 0,
+}
+
+// Variants of XX and IK for anonymous clients, which have no static key
+
+var noiseNX = &noisePattern{
+	ID:   3,
+	Name: "NX",
+	Messages: [][]noiseToken{
+		{tokenE},
+		{tokenE, tokenEE, tokenS, tokenES},
+	},
+	PSKMessage: 0,
+}
+
+var noiseNK = &noisePattern{
+	ID:                 4,
+	Name:               "NK",
+	PreResponderStatic: true,
+	Messages: [][]noiseToken{
+		{tokenE, tokenES},
+		{tokenE, tokenEE},
+	},
+	PSKMessage: 0,
+}
+
+// Name of the protocol as defined by the framework, e.g Noise_XX_25519_AESGCM_SHA256
+func noiseProtocolName(pattern *noisePattern, suite CipherSuite, psk bool) (string, error) {
+	var cipherName string
+	switch suite {
+	case SUITE_AES_256_GCM:
+		cipherName = "AESGCM"
+	case SUITE_CHACHA20_POLY1305:
+		cipherName = "ChaChaPoly"
+	default:
+		return "", fmt.Errorf("unsupported cipher suite: %s", suite.String())
+	}
+
+	name := pattern.Name
+	if psk {
+		// Only psk0 is placed before the first token, others go after them
+		name += fmt.Sprintf("psk%d", pattern.PSKMessage+1)
+	}
+
+	return fmt.Sprintf("Noise_%s_25519_%s_SHA256", name, cipherName), nil
+}
+
+type noiseState struct {
+	suite CipherSuite
+	ck    [32]byte
+	h     [32]byte
+	aead  cipher.AEAD
+	n     uint64
+	psk   *[32]byte
+
+	initiator bool
+	s         *KeyPair
+	// Generated when sent, set in advance only by tests
+	e  *KeyPair
+	rs *[32]byte
+	re *[32]byte
+}
+
+func newNoiseState(pattern *noisePattern, suite CipherSuite, initiator bool, prologue []byte, psk *[32]byte) (*noiseState, error) {
+	name, err := noiseProtocolName(pattern, suite, psk != nil)
+	if err != nil {
+		return nil, err
+	}
+
+	st := &noiseState{
+		suite:     suite,
+		psk:       psk,
+		initiator: initiator,
+	}
+
+	if len(name) <= len(st.h) {
+		copy(st.h[:], name)
+	} else {
+		st.h = sha256.Sum256([]byte(name))
+	}
+
+	st.ck = st.h
+	st.mixHash(prologue)
+
+	return st, nil
+}
+
+func (st *noiseState) mixHash(data []byte) {
+	hash := sha256.New()
+	hash.Write(st.h[:])
+	hash.Write(data)
+	hash.Sum(st.h[:0])
+}
+
+func (st *noiseState) hkdf(ikm []byte, outputs int) ([][32]byte, error) {
+	kdf := hkdf.New(sha256.New, ikm, st.ck[:], nil)
+
+	out := make([][32]byte, outputs)
+	for i := range out {
+		if _, err := io.ReadFull(kdf, out[i][:]); err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+func (st *noiseState) setKey(key [32]byte) error {
+	aead, err := st.suite.NewAEAD(key[:])
+	if err != nil {
+		return err
+	}
+
+	st.aead = aead
+	st.n = 0
+
+	return nil
+}
+
+func (st *noiseState) mixKey(ikm []byte) error {
+	out, err := st.hkdf(ikm, 2)
+	if err != nil {
+		return err
+	}
+
+	st.ck = out[0]
+	return st.setKey(out[1])
+}
+
+func (st *noiseState) mixKeyAndHash(ikm []byte) error {
+	out, err := st.hkdf(ikm, 3)
+	if err != nil {
+		return err
+	}
+
+	st.ck = out[0]
+	st.mixHash(out[1][:])
+	return st.setKey(out[2])
+}
+
+// Nonce encoding differs between ciphers of the framework
+func (st *noiseState) nonce() []byte {
+	nonce := make([]byte, nonceSize)
+	if st.suite == SUITE_CHACHA20_POLY1305 {
+		binary.LittleEndian.PutUint64(nonce[4:], st.n)
+	} else {
+		binary.BigEndian.PutUint64(nonce[4:], st.n)
+	}
+	return nonce
+}
+
+func (st *noiseState) encryptAndHash(plain []byte) []byte {
+	out := plain
+	if st.aead != nil {
+		out = st.aead.Seal(nil, st.nonce(), plain, st.h[:])
+		st.n++
+	}
+
+	st.mixHash(out)
+	return out
+}
+
+func (st *noiseState) decryptAndHash(data []byte) ([]byte, error) {
+	out := data
+	if st.aead != nil {
+		plain, err := st.aead.Open(nil, st.nonce(), data, st.h[:])
+		if err != nil {
+			return nil, ErrHandshakeFailed
+		}
+		out = plain
+		st.n++
+	}
+
+	st.mixHash(data)
+	return out, nil
+}
+
+func (st *noiseState) split() (*SessionKeys, error) {
+	out, err := st.hkdf(nil, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SessionKeys{
+		ClientToServer: out[0],
+		ServerToClient: out[1],
+	}, nil
+}
+
+func (st *noiseState) dh(token noiseToken) error {
+	var local *KeyPair
+	var remote *[32]byte
+
+	// es and se are named from the initiator's point of view
+	switch {
+	case token == tokenEE:
+		local, remote = st.e, st.re
+	case token == tokenSS:
+		local, remote = st.s, st.rs
+	case (token == tokenES) == st.initiator:
+		local, remote = st.e, st.rs
+	default:
+		local, remote = st.s, st.re
+	}
+
+	if local == nil || remote == nil {
+		return errors.New("handshake pattern requires a missing key")
+	}
+
+	shared, err := DeriveSharedKey(local.Private, *remote)
+	if err != nil {
+		return err
+	}
+
+	return st.mixKey(shared[:])
+}
+
+func (st *noiseState) writeMessage(tokens []noiseToken, withPSK bool, payload []byte) ([]byte, error) {
+	var msg []byte
+
+	for _, token := range tokens {
+		switch token {
+		case tokenE:
+			if st.e == nil {
+				e, err := GenerateKeyPair()
+				if err != nil {
+					return nil, err
+				}
+				st.e = e
+			}
+			msg = append(msg, st.e.Public[:]...)
+			st.mixHash(st.e.Public[:])
+			if st.psk != nil {
+				if err := st.mixKey(st.e.Public[:]); err != nil {
+					return nil, err
+				}
+			}
+		case tokenS:
+			msg = append(msg, st.encryptAndHash(st.s.Public[:])...)
+		default:
+			if err := st.dh(token); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if withPSK {
+		if err := st.mixKeyAndHash(st.psk[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	// Even empty payload authenticates the message once there's a key
+	return append(msg, st.encryptAndHash(payload)...), nil
+}
+
+func (st *noiseState) readMessage(tokens []noiseToken, withPSK bool, msg []byte) ([]byte, error) {
+	next := func(size int) ([]byte, error) {
+		if len(msg) < size {
+			return nil, errors.New("handshake message is too short")
+		}
+		part := msg[:size]
+		msg = msg[size:]
+		return part, nil
+	}
+
+	for _, token := range tokens {
+		switch token {
+		case tokenE:
+			raw, err := next(32)
+			if err != nil {
+				return nil, err
+			}
+			re := [32]byte(raw)
+			st.re = &re
+			st.mixHash(re[:])
+			if st.psk != nil {
+				if err := st.mixKey(re[:]); err != nil {
+					return nil, err
+				}
+			}
+		case tokenS:
+			size := 32
+			if st.aead != nil {
+				size += tagSize
+			}
+			raw, err := next(size)
+			if err != nil {
+				return nil, err
+			}
+			plain, err := st.decryptAndHash(raw)
+			if err != nil {
+				return nil, err
+			}
+			rs := [32]byte(plain)
+			st.rs = &rs
+		default:
+			if err := st.dh(token); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if withPSK {
+		if err := st.mixKeyAndHash(st.psk[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	return st.decryptAndHash(msg)
+}
+
+// noiseHandshake runs the pattern over the connection. Before the first
+// message the client sends id of the pattern and the cipher suites it
+// offers, server answers with the chosen suite. All of it is part of the
+// prologue, the chosen suite also names the protocol.
+type noiseHandshake struct {
+	// Pattern of clients with identity key
+	pattern *noisePattern
+	// Pattern of anonymous clients
+	anonymous *noisePattern
+}
+
+var (
+	// Both sides prove their identity keys, server's key is sent encrypted
+	NoiseXX Handshake = &noiseHandshake{pattern: noiseXX, anonymous: noiseNX}
+	// Client has to know server's identity key beforehand, handshake takes
+	// a single round trip after the negotiation
+	NoiseIK Handshake = &noiseHandshake{pattern: noiseIK, anonymous: noiseNK}
+)
+
+const noisePrologue = "hsp noise"
+
+func (nh *noiseHandshake) String() string {
+	return "Noise_" + nh.pattern.Name
+}
+
+func (nh *noiseHandshake) Server(conn net.Conn, config *ServerConfig) (*Connection, error) {
+	if config == nil || config.Identity == nil {
+		return nil, errors.New("server identity key is not configured")
+	}
+
+	preferred := config.CipherSuites
+	if len(preferred) == 0 {
+		preferred = DefaultCipherSuites
+	}
+
+	// Pattern id and number of offered suites
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return nil, err
+	}
+
+	var pattern *noisePattern
+	switch head[0] {
+	case nh.pattern.ID:
+		pattern = nh.pattern
+	case nh.anonymous.ID:
+		pattern = nh.anonymous
+	default:
+		return nil, ErrPatternMismatch
+	}
+
+	offered := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, offered); err != nil {
+		return nil, err
+	}
+
+	suites := make([]CipherSuite, len(offered))
+	for i, suite := range offered {
+		suites[i] = CipherSuite(suite)
+	}
+
+	suite := SelectCipherSuite(preferred, suites)
+	if err := writeAll(conn, []byte{byte(suite)}); err != nil {
+		return nil, err
+	}
+
+	if suite == SUITE_NONE {
+		return nil, ErrNoCommonSuite
+	}
+
+	prologue := concat([]byte(noisePrologue), head, offered, []byte{byte(suite)})
+
+	st, err := newNoiseState(pattern, suite, false, prologue, config.PreSharedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	st.s = config.Identity
+
+	if pattern.PreResponderStatic {
+		st.mixHash(st.s.Public[:])
+	}
+
+	if err := run(conn, pattern, st, nil); err != nil {
+		return nil, err
+	}
+
+	keys, err := st.split()
+	if err != nil {
+		return nil, err
+	}
+
+	connection := NewConnection(conn, st.e, keys.ServerToClient, keys.ClientToServer)
+	connection.Suite = suite
+	// Stays nil for anonymous clients
+	connection.PeerIdentity = st.rs
+	connection.ClientRandom = *st.re
+
+	return connection, nil
+}
+
+func (nh *noiseHandshake) Client(conn net.Conn, config *ClientConfig) (*Connection, error) {
+	if config == nil {
+		config = &ClientConfig{}
+	}
+
+	offered := config.CipherSuites
+	if len(offered) == 0 {
+		offered = DefaultCipherSuites
+	}
+
+	pattern := nh.pattern
+	if config.Identity == nil {
+		pattern = nh.anonymous
+	}
+
+	negotiation := []byte{pattern.ID, byte(len(offered))}
+	for _, suite := range offered {
+		negotiation = append(negotiation, byte(suite))
+	}
+
+	var rs *[32]byte
+	if pattern.PreResponderStatic {
+		key, err := knownServerKey(config)
+		if err != nil {
+			return nil, err
+		}
+		rs = &key
+	}
+
+	if err := writeAll(conn, negotiation); err != nil {
+		return nil, err
+	}
+
+	var chosen [1]byte
+	if _, err := io.ReadFull(conn, chosen[:]); err != nil {
+		return nil, err
+	}
+
+	suite := CipherSuite(chosen[0])
+	if suite == SUITE_NONE {
+		return nil, ErrNoCommonSuite
+	}
+
+	if !slices.Contains(offered, suite) {
+		return nil, fmt.Errorf("server chose cipher suite which wasn't offered: %s", suite.String())
+	}
+
+	st, err := newNoiseState(pattern, suite, true, concat([]byte(noisePrologue), negotiation, chosen[:]), config.PreSharedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	st.s = config.Identity
+
+	if rs != nil {
+		st.rs = rs
+		st.mixHash(rs[:])
+	}
+
+	verify := func(key [32]byte) error {
+		return verifyServerKey(config, key)
+	}
+
+	if err := run(conn, pattern, st, verify); err != nil {
+		return nil, err
+	}
+
+	keys, err := st.split()
+	if err != nil {
+		return nil, err
+	}
+
+	if st.rs != nil {
+		if err := rememberServerKey(config, *st.rs); err != nil {
+			return nil, err
+		}
+	}
+
+	connection := NewConnection(conn, st.e, keys.ClientToServer, keys.ServerToClient)
+	connection.Suite = suite
+	connection.PeerIdentity = st.rs
+	connection.ClientRandom = st.e.Public
+	connection.client = true
+
+	return connection, nil
+}
+
+// run exchanges messages of the pattern with empty payloads. verify is
+// called with the received static key of the peer, before anything else is
+// sent.
+func run(conn net.Conn, pattern *noisePattern, st *noiseState, verify func(key [32]byte) error) error {
+	for i, tokens := range pattern.Messages {
+		withPSK := st.psk != nil && i == pattern.PSKMessage
+
+		if (i%2 == 0) == st.initiator {
+			msg, err := st.writeMessage(tokens, withPSK, nil)
+			if err != nil {
+				return err
+			}
+
+			if err := writeNoiseMessage(conn, msg); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		msg, err := readNoiseMessage(conn)
+		if err != nil {
+			return err
+		}
+
+		if _, err := st.readMessage(tokens, withPSK, msg); err != nil {
+			return err
+		}
+
+		if verify != nil && slices.Contains(tokens, tokenS) {
+			if err := verify(*st.rs); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// knownServerKey returns server's identity key, which the client has pinned
+// or remembered from previous connections
+func knownServerKey(config *ClientConfig) ([32]byte, error) {
+	if config.PinnedKey != nil {
+		return *config.PinnedKey, nil
+	}
+
+	if config.KnownHosts != nil {
+		key, found, err := config.KnownHosts.Lookup(config.Host)
+		if err != nil {
+			return key, err
+		}
+		if found {
+			return key, nil
+		}
+	}
+
+	return [32]byte{}, ErrUnknownServerKey
+}
+
+// Messages are prefixed with their length as recommended by the framework
+func writeNoiseMessage(conn net.Conn, msg []byte) error {
+	return writeAll(conn, concat(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg))
+}
+
+func readNoiseMessage(conn net.Conn) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
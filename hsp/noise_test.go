@@ -0,0 +1,431 @@
+package hsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestNoiseXX(t *testing.T) {
+	identity, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate identity:", err)
+	}
+
+	clientIdentity, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate client identity:", err)
+	}
+
+	for _, suite := range DefaultCipherSuites {
+		server, client, err := handshakeWith(t, NoiseXX, NoiseXX,
+			&ServerConfig{Identity: identity},
+			&ClientConfig{Identity: clientIdentity, PinnedKey: &identity.Public, CipherSuites: []CipherSuite{suite}},
+		)
+		if err != nil {
+			t.Fatalf("ERR: Handshake with %s failed: %v", suite, err)
+		}
+
+		if server.SendKey != client.RecvKey || server.RecvKey != client.SendKey {
+			t.Error("Server and client derived different keys")
+		}
+
+		if server.Suite != suite || client.Suite != suite {
+			t.Errorf("Expected %s to be used, got %s and %s", suite, server.Suite, client.Suite)
+		}
+
+		if server.PeerIdentity == nil || *server.PeerIdentity != clientIdentity.Public {
+			t.Error("Server didn't learn the client identity")
+		}
+
+		if client.PeerIdentity == nil || *client.PeerIdentity != identity.Public {
+			t.Error("Client didn't learn the server identity")
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := client.Write(BuildPacket(Header{H_ROUTE: {"/noise"}}, []byte("hello")))
+			done <- err
+		}()
+
+		pkt, err := server.Read()
+		if err != nil {
+			t.Fatal("ERR: Failed to read packet:", err)
+		}
+
+		if err := <-done; err != nil {
+			t.Fatal("ERR: Failed to write packet:", err)
+		}
+
+		if !bytes.Equal(pkt.Payload, []byte("hello")) {
+			t.Errorf("Unexpected payload: %q", pkt.Payload)
+		}
+
+		server.Close()
+		client.Close()
+	}
+
+	impostor, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate identity:", err)
+	}
+
+	_, _, err = handshakeWith(t, NoiseXX, NoiseXX, &ServerConfig{Identity: impostor}, &ClientConfig{PinnedKey: &identity.Public})
+	if !errors.Is(err, ErrHostKeyMismatch) {
+		t.Error("Expected host key mismatch, got:", err)
+	}
+}
+
+func TestNoiseIK(t *testing.T) {
+	identity, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate identity:", err)
+	}
+
+	server, client, err := handshakeWith(t, NoiseIK, NoiseIK, &ServerConfig{Identity: identity}, &ClientConfig{PinnedKey: &identity.Public})
+	if err != nil {
+		t.Fatal("ERR: Handshake failed:", err)
+	}
+
+	if server.SendKey != client.RecvKey || server.RecvKey != client.SendKey {
+		t.Error("Server and client derived different keys")
+	}
+
+	_, _, err = handshakeWith(t, NoiseIK, NoiseIK, &ServerConfig{Identity: identity}, &ClientConfig{})
+	if !errors.Is(err, ErrUnknownServerKey) {
+		t.Error("Expected unknown server key, got:", err)
+	}
+
+	other, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate identity:", err)
+	}
+
+	if _, _, err = handshakeWith(t, NoiseIK, NoiseIK, &ServerConfig{Identity: identity}, &ClientConfig{PinnedKey: &other.Public}); err == nil {
+		t.Error("Handshake with wrong server key succeeded")
+	}
+}
+
+func TestNoisePreSharedKey(t *testing.T) {
+	identity, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate identity:", err)
+	}
+
+	clientIdentity, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate client identity:", err)
+	}
+
+	psk := [32]byte{1, 2, 3}
+	other := [32]byte{3, 2, 1}
+
+	for _, kind := range []Handshake{NoiseXX, NoiseIK} {
+		for _, client := range []*KeyPair{clientIdentity, nil} {
+			if _, _, err := handshakeWith(t, kind, kind,
+				&ServerConfig{Identity: identity, PreSharedKey: &psk},
+				&ClientConfig{Identity: client, PinnedKey: &identity.Public, PreSharedKey: &psk},
+			); err != nil {
+				t.Fatalf("ERR: Handshake %v with pre-shared key failed: %v", kind, err)
+			}
+
+			// Server has to refuse the client itself, not only the other way around
+			server, _, err := serverHandshake(t, kind,
+				&ServerConfig{Identity: identity, PreSharedKey: &psk},
+				&ClientConfig{Identity: client, PinnedKey: &identity.Public, PreSharedKey: &other},
+			)
+			if !errors.Is(err, ErrHandshakeFailed) {
+				t.Errorf("Expected %v server to fail with wrong pre-shared key, got: %v", kind, err)
+			}
+
+			if server != nil {
+				t.Errorf("Server accepted %v handshake with wrong pre-shared key", kind)
+			}
+		}
+	}
+}
+
+// serverHandshake returns result of the server side, whatever happened to
+// the client
+func serverHandshake(t *testing.T, kind Handshake, server *ServerConfig, client *ClientConfig) (*Connection, *Connection, error) {
+	t.Helper()
+
+	left, right := net.Pipe()
+	defer left.Close()
+	defer right.Close()
+
+	done := make(chan *Connection, 1)
+	go func() {
+		conn, _ := kind.Client(left, client)
+		left.Close()
+		done <- conn
+	}()
+
+	conn, err := kind.Server(right, server)
+	right.Close()
+
+	return conn, <-done, err
+}
+
+func TestNoiseAnonymousClient(t *testing.T) {
+	identity, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate identity:", err)
+	}
+
+	for _, kind := range []Handshake{NoiseXX, NoiseIK} {
+		server, client, err := handshakeWith(t, kind, kind, &ServerConfig{Identity: identity}, &ClientConfig{PinnedKey: &identity.Public})
+		if err != nil {
+			t.Fatalf("ERR: Anonymous %v handshake failed: %v", kind, err)
+		}
+
+		if server.PeerIdentity != nil {
+			t.Errorf("Anonymous %v client has an identity", kind)
+		}
+
+		if client.PeerIdentity == nil || *client.PeerIdentity != identity.Public {
+			t.Errorf("Anonymous %v client didn't learn the server identity", kind)
+		}
+
+		if server.SendKey != client.RecvKey || server.RecvKey != client.SendKey {
+			t.Error("Server and client derived different keys")
+		}
+	}
+}
+
+func TestNoiseCipherSuites(t *testing.T) {
+	identity, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate identity:", err)
+	}
+
+	for _, kind := range []Handshake{NoiseXX, NoiseIK} {
+		server, client, err := handshakeWith(t, kind, kind,
+			&ServerConfig{Identity: identity, CipherSuites: []CipherSuite{SUITE_CHACHA20_POLY1305}},
+			&ClientConfig{PinnedKey: &identity.Public, CipherSuites: []CipherSuite{SUITE_AES_256_GCM, SUITE_CHACHA20_POLY1305}},
+		)
+		if err != nil {
+			t.Fatalf("ERR: Handshake %v failed: %v", kind, err)
+		}
+
+		if server.Suite != SUITE_CHACHA20_POLY1305 || client.Suite != SUITE_CHACHA20_POLY1305 {
+			t.Errorf("Expected %s to be selected, got %s and %s", SUITE_CHACHA20_POLY1305, server.Suite, client.Suite)
+		}
+
+		_, _, err = handshakeWith(t, kind, kind,
+			&ServerConfig{Identity: identity, CipherSuites: []CipherSuite{SUITE_AES_256_GCM}},
+			&ClientConfig{PinnedKey: &identity.Public, CipherSuites: []CipherSuite{SUITE_CHACHA20_POLY1305}},
+		)
+		if !errors.Is(err, ErrNoCommonSuite) {
+			t.Error("Expected no common suite, got:", err)
+		}
+	}
+}
+
+func TestNoisePatternMismatch(t *testing.T) {
+	identity, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate identity:", err)
+	}
+
+	_, _, err = handshakeWith(t, NoiseXX, NoiseIK, &ServerConfig{Identity: identity}, &ClientConfig{PinnedKey: &identity.Public})
+	if err == nil {
+		t.Error("Handshake with different patterns succeeded")
+	}
+}
+
+var noiseVectorName = regexp.MustCompile(`^Noise_([A-Z]+)(psk\d)?_25519_(AESGCM|ChaChaPoly)_SHA256$`)
+
+// readNoiseVectors parses blocks of key=value lines separated by empty lines
+func readNoiseVectors(t *testing.T, path string) []map[string]string {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal("ERR: Failed to open vectors:", err)
+	}
+	defer file.Close()
+
+	var vectors []map[string]string
+	var current map[string]string
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			current = nil
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			t.Fatalf("ERR: Malformed vector line: %q", line)
+		}
+
+		if current == nil {
+			current = map[string]string{}
+			vectors = append(vectors, current)
+		}
+		current[key] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		t.Fatal("ERR: Failed to read vectors:", err)
+	}
+
+	return vectors
+}
+
+func TestNoiseVectors(t *testing.T) {
+	patterns := map[string]*noisePattern{"XX": noiseXX, "IK": noiseIK, "NX": noiseNX, "NK": noiseNK}
+	suites := map[string]CipherSuite{"AESGCM": SUITE_AES_256_GCM, "ChaChaPoly": SUITE_CHACHA20_POLY1305}
+
+	vectors := readNoiseVectors(t, "testdata/noise_vectors.txt")
+	if len(vectors) == 0 {
+		t.Fatal("ERR: No vectors found")
+	}
+
+	for _, vector := range vectors {
+		name := vector["handshake"]
+		t.Run(name, func(t *testing.T) {
+			bytesOf := func(key string) []byte {
+				value, err := hex.DecodeString(vector[key])
+				if err != nil {
+					t.Fatalf("ERR: Invalid hex in %s: %v", key, err)
+				}
+				return value
+			}
+
+			keyOf := func(key string) *KeyPair {
+				if _, ok := vector[key]; !ok {
+					return nil
+				}
+				pair, err := keyPairFromPrivate(bytesOf(key))
+				if err != nil {
+					t.Fatalf("ERR: Invalid key in %s: %v", key, err)
+				}
+				return pair
+			}
+
+			match := noiseVectorName.FindStringSubmatch(name)
+			if match == nil {
+				t.Fatal("ERR: Unknown protocol name")
+			}
+
+			pattern, suite := patterns[match[1]], suites[match[3]]
+
+			var psk *[32]byte
+			if _, ok := vector["preshared_key"]; ok {
+				key := [32]byte(bytesOf("preshared_key"))
+				psk = &key
+			}
+
+			if got, err := noiseProtocolName(pattern, suite, psk != nil); err != nil || got != name {
+				t.Fatalf("ERR: Protocol name %q doesn't match: %v", got, err)
+			}
+
+			initiator, err := newNoiseState(pattern, suite, true, bytesOf("prologue"), psk)
+			if err != nil {
+				t.Fatal("ERR: Failed to create initiator:", err)
+			}
+
+			responder, err := newNoiseState(pattern, suite, false, bytesOf("prologue"), psk)
+			if err != nil {
+				t.Fatal("ERR: Failed to create responder:", err)
+			}
+
+			initiator.s, initiator.e = keyOf("init_static"), keyOf("gen_init_ephemeral")
+			responder.s, responder.e = keyOf("resp_static"), keyOf("gen_resp_ephemeral")
+
+			if pattern.PreResponderStatic {
+				initiator.rs = &responder.s.Public
+				initiator.mixHash(responder.s.Public[:])
+				responder.mixHash(responder.s.Public[:])
+			}
+
+			for i, tokens := range pattern.Messages {
+				sender, receiver := initiator, responder
+				if i%2 == 1 {
+					sender, receiver = responder, initiator
+				}
+
+				prefix := "msg_" + strconv.Itoa(i)
+				withPSK := psk != nil && i == pattern.PSKMessage
+
+				msg, err := sender.writeMessage(tokens, withPSK, bytesOf(prefix+"_payload"))
+				if err != nil {
+					t.Fatalf("ERR: Failed to write message %d: %v", i, err)
+				}
+
+				if !bytes.Equal(msg, bytesOf(prefix+"_ciphertext")) {
+					t.Fatalf("Message %d differs:\n%x\n%x", i, msg, bytesOf(prefix+"_ciphertext"))
+				}
+
+				payload, err := receiver.readMessage(tokens, withPSK, msg)
+				if err != nil {
+					t.Fatalf("ERR: Failed to read message %d: %v", i, err)
+				}
+
+				if !bytes.Equal(payload, bytesOf(prefix+"_payload")) {
+					t.Fatalf("Payload of message %d differs: %x", i, payload)
+				}
+			}
+
+			keys, err := initiator.split()
+			if err != nil {
+				t.Fatal("ERR: Failed to split:", err)
+			}
+
+			responderKeys, err := responder.split()
+			if err != nil {
+				t.Fatal("ERR: Failed to split:", err)
+			}
+
+			if *keys != *responderKeys {
+				t.Fatal("Initiator and responder derived different keys")
+			}
+
+			// Transport messages use split keys with empty associated data
+			var counters [2]uint64
+			for i := len(pattern.Messages); ; i++ {
+				prefix := "msg_" + strconv.Itoa(i)
+				if _, ok := vector[prefix+"_ciphertext"]; !ok {
+					break
+				}
+
+				// Transport messages start from the initiator whoever
+				// sent the last handshake message
+				direction := (i - len(pattern.Messages)) % 2
+
+				key := keys.ClientToServer
+				if direction == 1 {
+					key = keys.ServerToClient
+				}
+
+				aead, err := suite.NewAEAD(key[:])
+				if err != nil {
+					t.Fatal("ERR: Failed to create cipher:", err)
+				}
+
+				st := &noiseState{suite: suite, n: counters[direction]}
+				counters[direction]++
+
+				msg := aead.Seal(nil, st.nonce(), bytesOf(prefix+"_payload"), nil)
+				if !bytes.Equal(msg, bytesOf(prefix+"_ciphertext")) {
+					t.Fatalf("Transport message %d differs:\n%x\n%x", i, msg, bytesOf(prefix+"_ciphertext"))
+				}
+			}
+		})
+	}
+}
@@ -1,9 +1,9 @@
 package hsp
 
 import (
-	"bytes"
 	"fmt"
 	"net"
+	"strings"
 )
 
 const (
@@ -11,13 +11,82 @@ const (
 )
 
 const (
-	PacketVersion int = 2
+	// Version 3 adds request id to the packet, so several requests can be
+	// multiplexed over one connection. Version 4 derives separate keys for
+	// each direction of the connection. Version 5 authenticates the
+	// unencrypted part of the packet. Version 6 escapes header keys and
+	// values, so they can hold arbitrary bytes. Version 7 marks control
+	// packets with F_CONTROL and splits large payloads into fragments.
+	// Version 8 restricts header keys to tokens, which are no longer
+	// escaped, only values are.
+	PacketVersion int = 8
 )
 
+// Packet flags, sent in clear but authenticated. Bits which are not
+// defined here are reserved and ignored by receivers.
+const (
+	// Sender wants to keep the connection open for the following packets
+	F_KEEP_ALIVE int = 1 << 0
+	// Payload is compressed with the encoding named in content-encoding header
+	F_COMPRESSED int = 1 << 1
+	// Last packet of the response to the request id. Responses without it,
+	// like acknowledgment of a stream request, are followed by more packets
+	// for the same request. Keep-alive connections carry the next request
+	// after it.
+	F_END_STREAM int = 1 << 2
+	// Payload continues in the next packet with the same request id.
+	// Continuation fragments carry no headers.
+	F_MORE_FRAGMENTS int = 1 << 3
+	// Packet is consumed by Connection itself and never returned by Read,
+	// its kind is one of the bits below. Unknown control packets are skipped.
+	F_CONTROL int = 1 << 5
+	// Control packet carrying session ticket for resuming the session later
+	F_TICKET int = 1 << 6
+	// Control packet, following packets of the sender use the next key
+	F_REKEY int = 1 << 7
+)
+
+// Flags set only by Connection itself, application packets can't carry them
+const connectionFlags = F_MORE_FRAGMENTS | F_CONTROL | F_TICKET | F_REKEY
+
+var flagNames = []struct {
+	flag int
+	name string
+}{
+	{F_KEEP_ALIVE, "keep-alive"},
+	{F_COMPRESSED, "compressed"},
+	{F_END_STREAM, "end-stream"},
+	{F_MORE_FRAGMENTS, "more-fragments"},
+	{F_CONTROL, "control"},
+	{F_TICKET, "ticket"},
+	{F_REKEY, "rekey"},
+}
+
+// FormatFlags returns names of the set flags separated with '|'
+func FormatFlags(flags int) string {
+	var names []string
+	for _, f := range flagNames {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+			flags &^= f.flag
+		}
+	}
+
+	if flags != 0 {
+		names = append(names, fmt.Sprintf("%#x", flags))
+	}
+
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
 type RawPacket struct {
 	Magic       uint32
 	Version     uint8
 	Flags       uint8
+	RequestID   uint32
 	HeaderSize  uint16
 	PayloadSize uint32
 	Nonce       []byte
@@ -29,55 +98,45 @@ type RawPacket struct {
 type Packet struct {
 	Version int
 	Flags   int
-	Headers map[string]string
-	Payload []byte
+	// Identifies request in multiplexed connection, 0 if not multiplexed
+	RequestID uint32
+	Headers   Header
+	Payload   []byte
 }
 
 type PacketDuplex struct {
 	conn net.Conn
 }
 
-func BuildPacket(headers map[string]string, payload []byte) *Packet {
+func BuildPacket(headers Header, payload []byte) *Packet {
 	return &Packet{
 		Version: PacketVersion,
-		Flags:   0, // TODO:
 		Headers: headers,
 		Payload: payload,
 	}
 }
 
-func ParseHeaders(rawHeaders []byte, headers *map[string]string) error {
-	i := 0
-	for i < len(rawHeaders) {
-		if rawHeaders[i] == '\n' {
-			break
-		}
-		var key string
-		for rawHeaders[i] != ':' {
-			if rawHeaders[i] != ' ' {
-				key += string(rawHeaders[i])
-			}
-			i++
-		}
-		i++
-		var value string
-		for rawHeaders[i] != '\n' {
-			if rawHeaders[i] != ' ' {
-				value += string(rawHeaders[i])
-			}
-			i++
-		}
-		i++
-		(*headers)[key] = value
-	}
-	return nil
+// HasFlag reports whether all of the given flags are set
+func (p *Packet) HasFlag(flag int) bool {
+	return p.Flags&flag == flag
 }
 
-func SerializeHeaders(headers *map[string]string) []byte {
-	buf := new(bytes.Buffer)
-	for k, v := range *headers {
-		fmt.Fprintf(buf, "%s:%s\n", k, v)
-	}
-	fmt.Fprintf(buf, "\n")
-	return buf.Bytes()
+func (p *Packet) SetFlag(flag int) {
+	p.Flags |= flag
+}
+
+func (p *Packet) ClearFlag(flag int) {
+	p.Flags &^= flag
+}
+
+func (p *Packet) KeepAlive() bool {
+	return p.HasFlag(F_KEEP_ALIVE)
+}
+
+func (p *Packet) EndStream() bool {
+	return p.HasFlag(F_END_STREAM)
+}
+
+func (p *Packet) IsControl() bool {
+	return p.HasFlag(F_CONTROL)
 }
@@ -22,9 +22,26 @@ func (req *Request) Conn() *Connection {
 	return req.conn
 }
 
+// ClientKey returns identity public key the client proved possession of
+// during handshake, anonymous clients have none
+func (req *Request) ClientKey() ([32]byte, bool) {
+	if req.conn == nil || req.conn.PeerIdentity == nil {
+		return [32]byte{}, false
+	}
+
+	return *req.conn.PeerIdentity, true
+}
+
 func (req *Request) GetHeader(key string) (string, bool) {
-	value, ok := req.packet.Headers[key]
-	return value, ok
+	values := req.packet.Headers.Values(key)
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[0], true
+}
+
+func (req *Request) GetHeaderValues(key string) []string {
+	return req.packet.Headers.Values(key)
 }
 
 func (req *Request) GetRawPacket() *Packet {
@@ -32,8 +49,7 @@ func (req *Request) GetRawPacket() *Packet {
 }
 
 func (req *Request) GetDataFormat() (*DataFormat, error) {
-	// TODO: use predefined header names
-	format, ok := req.packet.Headers["data-format"]
+	format, ok := req.GetHeader(H_DATA_FORMAT)
 	if !ok {
 		return nil, errors.New("Data format header is not provided in request")
 	}
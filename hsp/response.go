@@ -6,34 +6,31 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"maps"
 	"strconv"
 )
 
 type Response struct {
 	StatusCode int
 	Format     DataFormat
-	Headers    map[string]string
+	Headers    Header
 	Payload    []byte
 }
 
 func NewPacketResponse(packet *Packet) *Response {
-	status, sok := packet.Headers[H_STATUS]
-	if !sok {
+	if !packet.Headers.Has(H_STATUS) {
 		panic(errors.New("Packet must contain status header for response"))
 	}
 
-	format, fok := packet.Headers[H_DATA_FORMAT]
-	if !fok {
+	if !packet.Headers.Has(H_DATA_FORMAT) {
 		panic(errors.New("Packet must contain data format header for response"))
 	}
 
-	s, err := strconv.Atoi(status)
+	s, err := strconv.Atoi(packet.Headers.Get(H_STATUS))
 	if err != nil {
 		panic(errors.New(fmt.Sprintf("Packet's status code is invalid: %s", err.Error())))
 	}
 
-	df, err := ParseDataFormat(format)
+	df, err := ParseDataFormat(packet.Headers.Get(H_DATA_FORMAT))
 	if err != nil {
 		panic(errors.New(fmt.Sprintf("Failed to parse packet's data format: %s", err.Error())))
 	}
@@ -49,7 +46,7 @@ func NewPacketResponse(packet *Packet) *Response {
 func NewStatusResponse(status int) *Response {
 	return &Response{
 		StatusCode: status,
-		Headers:    make(map[string]string),
+		Headers:    make(Header),
 		Format: DataFormat{
 			Format:   DF_BYTES,
 			Encoding: "",
@@ -61,7 +58,7 @@ func NewStatusResponse(status int) *Response {
 func NewTextResponse(text string) *Response {
 	return &Response{
 		StatusCode: STATUS_SUCCESS,
-		Headers:    make(map[string]string),
+		Headers:    make(Header),
 		Format: DataFormat{
 			Format:   DF_TEXT,
 			Encoding: E_UTF8,
@@ -73,7 +70,7 @@ func NewTextResponse(text string) *Response {
 func NewErrorResponse(err error) *Response {
 	return &Response{
 		StatusCode: STATUS_INTERNALERR,
-		Headers:    make(map[string]string),
+		Headers:    make(Header),
 		Format: DataFormat{
 			Format:   DF_TEXT,
 			Encoding: E_UTF8,
@@ -90,7 +87,7 @@ func NewJsonResponse(data any) (*Response, error) {
 
 	return &Response{
 		StatusCode: STATUS_SUCCESS,
-		Headers:    make(map[string]string),
+		Headers:    make(Header),
 		Format: DataFormat{
 			Format:   DF_JSON,
 			Encoding: E_UTF8,
@@ -100,25 +97,34 @@ func NewJsonResponse(data any) (*Response, error) {
 }
 
 func (res *Response) ToPacket() *Packet {
-	headers := make(map[string]string)
-
-	maps.Copy(headers, res.Headers)
+	// Headers could be filled as a literal, so keys are canonicalized here
+	headers := make(Header, len(res.Headers))
+	for key, values := range res.Headers {
+		for _, value := range values {
+			headers.Add(key, value)
+		}
+	}
 
 	if res.Format.Format == DF_BYTES {
-		headers[H_DATA_FORMAT] = DF_BYTES
+		headers.Set(H_DATA_FORMAT, DF_BYTES)
 	} else {
-		headers[H_DATA_FORMAT] = fmt.Sprintf("%s:%s", res.Format.Format, res.Format.Encoding)
+		headers.Set(H_DATA_FORMAT, fmt.Sprintf("%s:%s", res.Format.Format, res.Format.Encoding))
 	}
-	headers[H_STATUS] = strconv.Itoa(res.StatusCode)
+	headers.Set(H_STATUS, strconv.Itoa(res.StatusCode))
 
 	return BuildPacket(headers, res.Payload)
 }
 
+// AddHeader sets the header, replacing values already set for the key. Use
+// Headers.Add to give the key several values.
 func (res *Response) AddHeader(key, value string) {
-	if _, ok := res.Headers[key]; ok {
+	if res.Headers == nil {
+		res.Headers = make(Header)
+	}
+	if res.Headers.Has(key) {
 		log.Printf("WARN: Rewriting already existing header: '%s'\n", key)
 	}
-	res.Headers[key] = value
+	res.Headers.Set(key, value)
 }
 
 func (res *Response) Write(p []byte) (int, error) {
@@ -0,0 +1,38 @@
+package hsp
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestResponseToPacketCanonicalizesHeaders(t *testing.T) {
+	res := &Response{
+		StatusCode: STATUS_SUCCESS,
+		Format:     *TextDataFormat(),
+		Headers:    Header{"X-Foo": {"a", "b"}},
+	}
+
+	pkt := res.ToPacket()
+
+	if err := ValidateHeaders(pkt.Headers); err != nil {
+		t.Fatal("ERR: Headers of response literal can't be sent:", err)
+	}
+
+	if got := pkt.Headers.Values("x-foo"); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("Unexpected values: %q", got)
+	}
+
+	if _, ok := res.Headers["X-Foo"]; !ok || len(res.Headers) != 1 {
+		t.Error("Headers of the response were modified")
+	}
+}
+
+func TestResponseAddHeaderReplaces(t *testing.T) {
+	res := NewStatusResponse(STATUS_SUCCESS)
+	res.AddHeader("X-Stream", "1")
+	res.AddHeader("x-stream", "2")
+
+	if got := res.Headers.Values(H_STREAM); !slices.Equal(got, []string{"2"}) {
+		t.Errorf("Expected value to be replaced, got %q", got)
+	}
+}
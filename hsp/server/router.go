@@ -1,20 +1,58 @@
 package server
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/LandaMm/hsp-go/hsp"
 )
 
+const DefaultIdleTimeout = 60 * time.Second
+
+// Smaller responses are not worth compressing
+const DefaultCompressionThreshold = 1024
+
 type RouteHandler func(req *hsp.Request) *hsp.Response
 
+type StreamHandler func(req *hsp.Request, stream *hsp.Stream) *hsp.Response
+
 type Router struct {
-	routes map[string]RouteHandler
+	routes  map[string]RouteHandler
+	streams map[string]StreamHandler
+	// Maximum amount of bytes accepted in a single stream, 0 means unlimited
+	MaxStreamSize int64
+	// Keeps state of unfinished streams, streams can't be resumed if nil
+	Store StreamStore
+	// How long keep-alive connection may wait for the next request, 0 means forever
+	IdleTimeout time.Duration
+	// Responses of at least this size are compressed with an encoding the
+	// client accepts, 0 disables compression
+	CompressionThreshold int
+
+	// Streams being received, attempts to resume them wait for their turn
+	streamLocks   map[string]*streamLock
+	streamLocksMu sync.Mutex
+}
+
+type streamLock struct {
+	mu   sync.Mutex
+	refs int
 }
 
 func NewRouter() *Router {
 	return &Router{
-		routes: make(map[string]RouteHandler),
+		routes:      make(map[string]RouteHandler),
+		streams:     make(map[string]StreamHandler),
+		Store:       NewMemoryStreamStore(),
+		IdleTimeout: DefaultIdleTimeout,
+
+		CompressionThreshold: DefaultCompressionThreshold,
 	}
 }
 
@@ -25,29 +63,380 @@ func (r *Router) AddRoute(pathname string, handler RouteHandler) {
 	r.routes[pathname] = handler
 }
 
+func (r *Router) AddStreamRoute(pathname string, handler StreamHandler) {
+	if _, ok := r.streams[pathname]; ok {
+		log.Printf("WARN: Rewriting existing stream route '%s'\n", pathname)
+	}
+	r.streams[pathname] = handler
+}
+
+// RequireKey lets through only clients which proved one of the authorized
+// identity keys during handshake
+func RequireKey(keys *hsp.AuthorizedKeys, handler RouteHandler) RouteHandler {
+	return func(req *hsp.Request) *hsp.Response {
+		key, ok := req.ClientKey()
+		if !ok || !keys.Contains(key) {
+			return hsp.NewStatusResponse(hsp.STATUS_UNAUTHORIZED)
+		}
+		return handler(req)
+	}
+}
+
 func (r *Router) Handle(conn *hsp.Connection) error {
+	var inflight sync.WaitGroup
+
 	defer conn.Close()
+	defer inflight.Wait()
 
-	packet, err := conn.Read()
-	if err != nil {
-		_, _ = conn.Write(hsp.NewErrorResponse(err).ToPacket())
-		return err
+	for served := 0; ; served++ {
+		if r.IdleTimeout > 0 {
+			if err := conn.Conn.SetReadDeadline(time.Now().Add(r.IdleTimeout)); err != nil {
+				return err
+			}
+		}
+
+		packet, err := conn.Read()
+		if err != nil {
+			if served > 0 && isClosed(err) {
+				return nil
+			}
+			_ = r.reply(conn, hsp.NewErrorResponse(err).ToPacket(), false)
+			return err
+		}
+
+		// Multiplexed requests are answered as soon as they are handled,
+		// possibly out of order
+		if packet.RequestID != 0 {
+			inflight.Add(1)
+			go func() {
+				defer inflight.Done()
+				if err := r.replyTo(conn, packet.RequestID, r.serveMultiplexed(conn, packet)); err != nil {
+					log.Printf("WARN: Failed to reply to request %d: %v\n", packet.RequestID, err)
+				}
+			}()
+			continue
+		}
+
+		// Handlers might be reading streams for longer than idle timeout
+		if err := conn.Conn.SetReadDeadline(time.Time{}); err != nil {
+			return err
+		}
+
+		keepAlive := packet.KeepAlive()
+
+		reusable, err := r.handlePacket(conn, packet, keepAlive)
+		if err != nil || !keepAlive || !reusable {
+			return err
+		}
+	}
+}
+
+func (r *Router) handlePacket(conn *hsp.Connection, packet *hsp.Packet, keepAlive bool) (bool, error) {
+	req := hsp.NewRequest(conn, packet)
+
+	if packet.Headers.Has(hsp.H_ROUTE) {
+		if packet.Headers.Has(hsp.H_STREAM) {
+			return r.handleStream(req, packet.Headers.Get(hsp.H_ROUTE), keepAlive)
+		}
+	}
+
+	return true, r.reply(conn, r.serve(req), keepAlive)
+}
+
+// serveMultiplexed answers a single request of multiplexed connection. It
+// runs in its own goroutine, so panic of the handler is recovered here
+// instead of crashing the whole server
+func (r *Router) serveMultiplexed(conn *hsp.Connection, packet *hsp.Packet) (pkt *hsp.Packet) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("ERR: Handler of request %d panicked: %v\n", packet.RequestID, p)
+			pkt = hsp.NewStatusResponse(hsp.STATUS_INTERNALERR).ToPacket()
+		}
+	}()
+
+	// Stream data packets have no request id, so they can't be multiplexed
+	if packet.Headers.Has(hsp.H_STREAM) {
+		res := hsp.NewStatusResponse(hsp.STATUS_INTERNALERR)
+		res.AddHeader(hsp.H_STREAM, "-1")
+		return res.ToPacket()
+	}
+
+	return r.serve(hsp.NewRequest(conn, packet))
+}
+
+// serve builds packet of the handler's response, the response itself is
+// never modified, so handlers may return shared ones
+func (r *Router) serve(req *hsp.Request) *hsp.Packet {
+	res := r.route(req)
+	if res == nil {
+		res = hsp.NewStatusResponse(hsp.STATUS_SUCCESS)
 	}
 
-	if route, ok := packet.Headers["route"]; ok {
-		req := hsp.NewRequest(conn, packet)
+	pkt := res.ToPacket()
+	r.compress(req, pkt)
+	return pkt
+}
 
+func (r *Router) route(req *hsp.Request) *hsp.Response {
+	if route, ok := req.GetHeader(hsp.H_ROUTE); ok {
 		if handler, ok := r.routes[route]; ok {
-			res := handler(req)
-			_, err := conn.Write(res.ToPacket())
-			return err
+			return handler(req)
 		} else if fallback, ok := r.routes["*"]; ok {
-			res := fallback(req)
-			_, err := conn.Write(res.ToPacket())
-			return err
+			return fallback(req)
 		}
 	}
 
-	_, err = conn.Write(hsp.NewStatusResponse(hsp.STATUS_NOTFOUND).ToPacket())
+	return hsp.NewStatusResponse(hsp.STATUS_NOTFOUND)
+}
+
+// compress encodes payload of large response packets with the first encoding
+// the client accepts, packets already having content encoding are left as is
+func (r *Router) compress(req *hsp.Request, pkt *hsp.Packet) {
+	if r.CompressionThreshold <= 0 || len(pkt.Payload) < r.CompressionThreshold || pkt.Headers.Has(hsp.H_CONTENT_ENCODING) {
+		return
+	}
+
+	encoding := hsp.NegotiateEncoding(req.GetHeaderValues(hsp.H_ACCEPT_ENCODING))
+	if len(encoding) == 0 {
+		return
+	}
+
+	compressed, err := hsp.Compress(encoding, pkt.Payload)
+	if err != nil {
+		log.Printf("WARN: Failed to compress response with %s: %v\n", encoding, err)
+		return
+	}
+
+	// Incompressible payloads are sent as is
+	if len(compressed) >= len(pkt.Payload) {
+		return
+	}
+
+	pkt.Payload = compressed
+	pkt.Headers.Set(hsp.H_CONTENT_ENCODING, encoding)
+	pkt.SetFlag(hsp.F_COMPRESSED)
+}
+
+func (r *Router) reply(conn *hsp.Connection, pkt *hsp.Packet, keepAlive bool) error {
+	return r.send(conn, pkt, keepAlive, true)
+}
+
+func (r *Router) send(conn *hsp.Connection, pkt *hsp.Packet, keepAlive, last bool) error {
+	if keepAlive {
+		pkt.SetFlag(hsp.F_KEEP_ALIVE)
+	}
+	if last {
+		pkt.SetFlag(hsp.F_END_STREAM)
+	}
+
+	_, err := conn.Write(pkt)
 	return err
 }
+
+func (r *Router) replyTo(conn *hsp.Connection, id uint32, pkt *hsp.Packet) error {
+	pkt.SetFlag(hsp.F_KEEP_ALIVE | hsp.F_END_STREAM)
+	pkt.RequestID = id
+
+	_, err := conn.Write(pkt)
+	return err
+}
+
+func isClosed(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func (r *Router) handleStream(req *hsp.Request, route string, keepAlive bool) (bool, error) {
+	conn := req.Conn()
+
+	handler, ok := r.streams[route]
+	if !ok {
+		handler, ok = r.streams["*"]
+	}
+
+	if !ok {
+		return true, r.refuseStream(conn, hsp.STATUS_NOTFOUND, keepAlive)
+	}
+
+	value, _ := req.GetHeader(hsp.H_STREAM)
+	total, bufferSize, err := hsp.ParseStreamHeader(value)
+	if err != nil {
+		return true, r.refuseStream(conn, hsp.STATUS_INTERNALERR, keepAlive)
+	}
+
+	if bufferSize <= 0 {
+		bufferSize = hsp.DefaultStreamBufferSize
+	}
+
+	var state *StreamState
+
+	key, resumed := req.GetHeader(hsp.H_STREAM_KEY)
+	if resumed {
+		// State is loaded only after previous attempt has saved it
+		unlock := r.lockStream(key)
+		defer unlock()
+
+		state, err = r.resumeStream(key, route)
+	} else {
+		state, err = r.newStream(req, route, total)
+		if err == nil {
+			unlock := r.lockStream(state.Key)
+			defer unlock()
+		}
+	}
+
+	if errors.Is(err, ErrUnknownStream) {
+		return true, r.refuseStream(conn, hsp.STATUS_NOTFOUND, keepAlive)
+	}
+	if err != nil {
+		return true, r.refuseStream(conn, hsp.STATUS_INTERNALERR, keepAlive)
+	}
+
+	df, err := hsp.ParseDataFormat(state.Format)
+	if err != nil {
+		return true, r.refuseStream(conn, hsp.STATUS_INTERNALERR, keepAlive)
+	}
+
+	// Server sends 0 if it is able to receive whole amount of data
+	accepted := int64(0)
+	if resumed || state.Total < total {
+		accepted = state.Remaining()
+	}
+
+	ack := hsp.NewStatusResponse(hsp.STATUS_SUCCESS)
+	ack.Format = *df
+	ack.AddHeader(hsp.H_STREAM, hsp.FormatStreamHeader(accepted, bufferSize))
+	ack.AddHeader(hsp.H_STREAM_KEY, state.Key)
+	if resumed {
+		ack.AddHeader(hsp.H_STREAM_OFFSET, strconv.FormatInt(state.Received, 10))
+	}
+
+	// Final response follows the stream data
+	if err := r.send(conn, ack.ToPacket(), keepAlive, false); err != nil {
+		return false, err
+	}
+
+	stream := hsp.NewStream(conn, state.Key, state.Received, state.Remaining(), int(bufferSize))
+
+	res := handler(req, stream)
+	if res == nil {
+		res = hsp.NewStatusResponse(hsp.STATUS_SUCCESS)
+	}
+
+	state.Received += stream.Received()
+
+	if r.Store != nil {
+		if state.Remaining() > 0 {
+			err = r.Store.Save(state)
+		} else {
+			err = r.Store.Delete(state.Key)
+		}
+		if err != nil {
+			log.Printf("WARN: Failed to update state of stream '%s': %v\n", state.Key, err)
+		}
+	}
+
+	pkt := res.ToPacket()
+	pkt.Headers.Set(hsp.H_STREAM_KEY, state.Key)
+	pkt.Headers.Set(hsp.H_STREAM, hsp.FormatStreamHeader(state.Missing(), 0))
+	r.compress(req, pkt)
+
+	// Unread stream data is left in the connection, so it can't be reused
+	reusable := stream.Remaining() == 0
+
+	return reusable, r.reply(conn, pkt, keepAlive && reusable)
+}
+
+func (r *Router) newStream(req *hsp.Request, route string, total int64) (*StreamState, error) {
+	if total < 0 {
+		return nil, fmt.Errorf("invalid stream size: %d", total)
+	}
+
+	df, err := req.GetDataFormat()
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hsp.NewStreamKey()
+	if err != nil {
+		return nil, err
+	}
+
+	size := total
+	if r.MaxStreamSize > 0 && size > r.MaxStreamSize {
+		size = r.MaxStreamSize
+	}
+
+	state := &StreamState{
+		Key:       key,
+		Route:     route,
+		Format:    df.String(),
+		Total:     size,
+		Requested: total,
+	}
+
+	if r.Store != nil {
+		if err := r.Store.Save(state); err != nil {
+			return nil, err
+		}
+	}
+
+	return state, nil
+}
+
+// lockStream makes sure only one connection at a time receives data of the
+// stream, returned function releases the lock
+func (r *Router) lockStream(key string) func() {
+	r.streamLocksMu.Lock()
+	if r.streamLocks == nil {
+		r.streamLocks = make(map[string]*streamLock)
+	}
+	lock, ok := r.streamLocks[key]
+	if !ok {
+		lock = &streamLock{}
+		r.streamLocks[key] = lock
+	}
+	lock.refs++
+	r.streamLocksMu.Unlock()
+
+	lock.mu.Lock()
+
+	return func() {
+		lock.mu.Unlock()
+
+		r.streamLocksMu.Lock()
+		defer r.streamLocksMu.Unlock()
+
+		lock.refs--
+		if lock.refs == 0 {
+			delete(r.streamLocks, key)
+		}
+	}
+}
+
+func (r *Router) resumeStream(key, route string) (*StreamState, error) {
+	if r.Store == nil {
+		return nil, ErrUnknownStream
+	}
+
+	state, err := r.Store.Load(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if state.Route != route {
+		return nil, ErrUnknownStream
+	}
+
+	return state, nil
+}
+
+func (r *Router) refuseStream(conn *hsp.Connection, status int, keepAlive bool) error {
+	res := hsp.NewStatusResponse(status)
+	res.AddHeader(hsp.H_STREAM, "-1")
+	return r.reply(conn, res.ToPacket(), keepAlive)
+}
@@ -3,26 +3,67 @@ package server
 import (
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/LandaMm/hsp-go/hsp"
 )
 
+const (
+	DefaultHandshakeTimeout = 10 * time.Second
+	DefaultMaxHandshakes    = 64
+)
+
+type Handler interface {
+	Handle(conn *hsp.Connection) error
+}
+
 type Server struct {
 	Addr        hsp.Adddress
 	routePrefix string // TODO: Support route prefix, e.g listening on localhost/api
 	Running     bool
 	ConnChan    chan *hsp.Connection
-	listener    net.Listener
-	mu          sync.Mutex
+	// How long client has to complete the key exchange
+	HandshakeTimeout time.Duration
+	// Maximum amount of key exchanges performed at the same time
+	MaxHandshakes int
+	// Long-term key identifying the server, random one is generated if nil
+	Identity *hsp.KeyPair
+	// Accepted cipher suites in order of preference, hsp.DefaultCipherSuites if empty
+	CipherSuites []hsp.CipherSuite
+	// Key exchange used for new connections, hsp.LegacyHandshake if nil
+	Handshake hsp.Handshake
+	// Secret shared with clients, connections without it fail the handshake
+	PreSharedKey *[32]byte
+	// How long issued session tickets can be used for resuming sessions,
+	// 0 disables tickets
+	TicketLifetime time.Duration
+	// How often the key encrypting session tickets is replaced
+	TicketKeyRotation time.Duration
+	tickets           *hsp.TicketKeys
+	// Keys of every connection are appended to it, so captured traffic can
+	// be decrypted. Meant only for debugging
+	KeyLog io.Writer
+	// Logger for errors of single connections, standard logger is used if nil
+	ErrorLog *log.Logger
+	// Called instead of logging when single connection fails
+	OnError  func(remote net.Addr, err error)
+	handler  Handler
+	listener net.Listener
+	mu       sync.Mutex
 }
 
 func NewServer(addr hsp.Adddress) *Server {
 	return &Server{
-		Addr:        addr,
-		routePrefix: addr.Route,
-		Running:     false,
+		Addr:              addr,
+		routePrefix:       addr.Route,
+		Running:           false,
+		HandshakeTimeout:  DefaultHandshakeTimeout,
+		MaxHandshakes:     DefaultMaxHandshakes,
+		TicketLifetime:    hsp.DefaultTicketLifetime,
+		TicketKeyRotation: hsp.DefaultTicketKeyRotation,
 	}
 }
 
@@ -30,71 +71,176 @@ func (s *Server) SetListener(ln chan *hsp.Connection) {
 	s.ConnChan = ln
 }
 
+// SetHandler makes server handle every connection in its own goroutine,
+// instead of sending it to the listener channel
+func (s *Server) SetHandler(handler Handler) {
+	s.handler = handler
+}
+
 func (s *Server) Start() error {
 	ln, err := net.Listen("tcp", s.Addr.String())
 	if err != nil {
 		return err
 	}
 
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on the listener until server is stopped. Only
+// errors of the listener itself stop serving, failures of single
+// connections are reported through OnError or ErrorLog
+func (s *Server) Serve(ln net.Listener) error {
+	if s.Identity == nil {
+		identity, err := hsp.GenerateKeyPair()
+		if err != nil {
+			return err
+		}
+		s.Identity = identity
+	}
+
+	if s.TicketLifetime > 0 && s.tickets == nil {
+		s.tickets = hsp.NewTicketKeys(s.TicketLifetime, s.TicketKeyRotation)
+	}
+
 	s.mu.Lock()
 	s.listener = ln
 	s.Running = true
 	s.mu.Unlock()
 
+	defer func() {
+		s.mu.Lock()
+		s.Running = false
+		s.listener = nil
+		s.mu.Unlock()
+	}()
+
+	maxHandshakes := s.MaxHandshakes
+	if maxHandshakes <= 0 {
+		maxHandshakes = DefaultMaxHandshakes
+	}
+
+	handshakes := make(chan struct{}, maxHandshakes)
+
+	var tempDelay time.Duration
+
 	for s.IsRunning() {
 		conn, err := ln.Accept()
 		if err != nil {
 			if !s.IsRunning() {
 				break
 			}
-			return err
-		}
 
-		keys, err := hsp.GenerateKeyPair()
-		if err != nil {
-			return err
-		}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if tempDelay > time.Second {
+					tempDelay = time.Second
+				}
+
+				s.logf("ERR: Accept failed: %v, retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
 
-		// Receive client's public key
-		clientKey := make([]byte, 32)
-		n, err := io.ReadFull(conn, clientKey)
-		if err != nil {
 			return err
 		}
 
-		if n != 32 {
-			return fmt.Errorf("Received invalid client's key with %d bytes (expected 32 bytes)", n)
-		}
+		tempDelay = 0
 
-		// Send our public key to client
-		n, err = conn.Write(keys.Public[:])
-		if err != nil {
-			return err
-		}
+		handshakes <- struct{}{}
 
-		if n != 32 {
-			return fmt.Errorf("Couldn't send 32 bytes of public key (%d sent instead)", n)
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					s.connError(conn.RemoteAddr(), fmt.Errorf("panic serving connection: %v", r))
+					conn.Close()
+				}
+			}()
+
+			// Slot is released even if the handshake panics
+			connection, err := func() (*hsp.Connection, error) {
+				defer func() { <-handshakes }()
+				return s.handshake(conn)
+			}()
+
+			if err != nil {
+				s.connError(conn.RemoteAddr(), fmt.Errorf("handshake failed: %w", err))
+				conn.Close()
+				return
+			}
+
+			s.serve(connection)
+		}()
+	}
+
+	return nil
+}
+
+func (s *Server) handshake(conn net.Conn) (*hsp.Connection, error) {
+	if s.HandshakeTimeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(s.HandshakeTimeout)); err != nil {
+			return nil, err
 		}
+	}
 
-		sharedKey, err := hsp.DeriveSharedKey(keys.Private, [32]byte(clientKey))
-		if err != nil {
-			return err
+	handshake := s.Handshake
+	if handshake == nil {
+		handshake = hsp.LegacyHandshake
+	}
+
+	connection, err := handshake.Server(conn, &hsp.ServerConfig{
+		Identity:     s.Identity,
+		CipherSuites: s.CipherSuites,
+		PreSharedKey: s.PreSharedKey,
+		Tickets:      s.tickets,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	if s.KeyLog != nil {
+		if err := connection.LogKeys(s.KeyLog); err != nil {
+			s.logf("WARN: Failed to log keys of %s: %v", conn.RemoteAddr(), err)
 		}
+	}
 
-		if s.ConnChan != nil {
-			connection := hsp.NewConnection(conn, keys, sharedKey)
-			s.ConnChan <- connection
-		} else {
-			conn.Close()
+	return connection, nil
+}
+
+func (s *Server) serve(conn *hsp.Connection) {
+	if s.handler != nil {
+		if err := s.handler.Handle(conn); err != nil {
+			s.connError(conn.Conn.RemoteAddr(), err)
 		}
+	} else if s.ConnChan != nil {
+		s.ConnChan <- conn
+	} else {
+		conn.Close()
 	}
+}
 
-	s.mu.Lock()
-	s.Running = false
-	s.listener = nil
-	s.mu.Unlock()
+func (s *Server) connError(remote net.Addr, err error) {
+	if s.OnError != nil {
+		s.OnError(remote, err)
+		return
+	}
 
-	return nil
+	s.logf("ERR: Connection with %s failed: %v", remote, err)
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
 }
 
 func (s *Server) Stop() error {
@@ -0,0 +1,609 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/LandaMm/hsp-go/hsp"
+	"github.com/LandaMm/hsp-go/hsp/client"
+)
+
+// listen returns server for a random local port, it is stopped when the
+// test ends
+func listen(t *testing.T) (net.Listener, *Server) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("ERR: Failed to listen:", err)
+	}
+
+	addr, err := hsp.ParseAddress(ln.Addr().String())
+	if err != nil {
+		t.Fatal("ERR: Failed to parse address:", err)
+	}
+
+	srv := NewServer(*addr)
+	t.Cleanup(func() {
+		srv.Stop()
+		ln.Close()
+	})
+
+	return ln, srv
+}
+
+func TestServerSurvivesFailedHandshake(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("ERR: Failed to listen:", err)
+	}
+
+	addr, err := hsp.ParseAddress(ln.Addr().String())
+	if err != nil {
+		t.Fatal("ERR: Failed to parse address:", err)
+	}
+
+	errs := make(chan error, 1)
+
+	srv := NewServer(*addr)
+	srv.HandshakeTimeout = time.Second
+	srv.OnError = func(remote net.Addr, err error) {
+		errs <- err
+	}
+
+	router := NewRouter()
+	router.AddRoute("/ping", func(req *hsp.Request) *hsp.Response {
+		return hsp.NewTextResponse("pong")
+	})
+	srv.SetHandler(router)
+
+	go srv.Serve(ln)
+	defer srv.Stop()
+
+	// Client that sends only a part of its key and disconnects
+	bad, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("ERR: Failed to dial:", err)
+	}
+	bad.Write([]byte{1, 2, 3})
+	bad.Close()
+
+	select {
+	case err := <-errs:
+		t.Log("Reported handshake error:", err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Handshake error wasn't reported")
+	}
+
+	c := client.NewClient(&client.ClientOptions{BaseURL: ln.Addr().String()})
+
+	res, err := c.SendText("/ping", "ping")
+	if err != nil {
+		t.Fatal("ERR: Server stopped serving after failed handshake:", err)
+	}
+
+	if string(res.Payload) != "pong" {
+		t.Errorf("Unexpected response: %s", string(res.Payload))
+	}
+}
+
+func TestServerHandshakeDoesNotBlockOthers(t *testing.T) {
+	router := NewRouter()
+	router.AddRoute("/ping", func(req *hsp.Request) *hsp.Response {
+		return hsp.NewTextResponse("pong")
+	})
+
+	ln, srv := listen(t)
+	srv.HandshakeTimeout = 10 * time.Second
+	srv.SetHandler(router)
+
+	go srv.Serve(ln)
+
+	// Client which connects and never sends its hello
+	stalled, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("ERR: Failed to dial:", err)
+	}
+	defer stalled.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		c := client.NewClient(&client.ClientOptions{BaseURL: ln.Addr().String()})
+		defer c.Close()
+
+		_, err := c.SendText("/ping", "")
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("ERR: Failed to send request:", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stalled handshake blocked other clients")
+	}
+}
+
+// panickingHandshake panics on the server side until it is disarmed
+type panickingHandshake struct {
+	armed *atomic.Bool
+}
+
+func (h panickingHandshake) Server(conn net.Conn, config *hsp.ServerConfig) (*hsp.Connection, error) {
+	if h.armed.Load() {
+		panic("handshake")
+	}
+	return hsp.LegacyHandshake.Server(conn, config)
+}
+
+func (h panickingHandshake) Client(conn net.Conn, config *hsp.ClientConfig) (*hsp.Connection, error) {
+	return hsp.LegacyHandshake.Client(conn, config)
+}
+
+func TestServerReleasesHandshakeOnPanic(t *testing.T) {
+	router := NewRouter()
+	router.AddRoute("/ping", func(req *hsp.Request) *hsp.Response {
+		return hsp.NewTextResponse("pong")
+	})
+
+	handshake := panickingHandshake{armed: &atomic.Bool{}}
+	handshake.armed.Store(true)
+
+	panics := make(chan error, 3)
+
+	ln, srv := listen(t)
+	srv.MaxHandshakes = 1
+	srv.Handshake = handshake
+	srv.OnError = func(remote net.Addr, err error) {
+		panics <- err
+	}
+	srv.SetHandler(router)
+
+	go srv.Serve(ln)
+
+	for range 3 {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal("ERR: Failed to dial:", err)
+		}
+		defer conn.Close()
+
+		select {
+		case err := <-panics:
+			t.Log("Reported panic:", err)
+		case <-time.After(2 * time.Second):
+			t.Fatal("Panic of handshake wasn't reported")
+		}
+	}
+
+	handshake.armed.Store(false)
+
+	done := make(chan error, 1)
+	go func() {
+		c := client.NewClient(&client.ClientOptions{BaseURL: ln.Addr().String()})
+		defer c.Close()
+
+		_, err := c.SendText("/ping", "")
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("ERR: Failed to send request:", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Handshake slots leaked after panics")
+	}
+}
+
+// handlerFunc lets tests watch connections handled by the router
+type handlerFunc func(conn *hsp.Connection) error
+
+func (f handlerFunc) Handle(conn *hsp.Connection) error {
+	return f(conn)
+}
+
+func TestRouterKeepAlive(t *testing.T) {
+	conns := make(chan *hsp.Connection, 10)
+
+	router := NewRouter()
+	router.IdleTimeout = 200 * time.Millisecond
+	router.AddRoute("/ping", func(req *hsp.Request) *hsp.Response {
+		conns <- req.Conn()
+		return hsp.NewTextResponse("pong")
+	})
+
+	closed := make(chan error, 1)
+
+	ln, srv := listen(t)
+	srv.SetHandler(handlerFunc(func(conn *hsp.Connection) error {
+		err := router.Handle(conn)
+		closed <- err
+		return err
+	}))
+
+	go srv.Serve(ln)
+
+	c := client.NewClient(&client.ClientOptions{BaseURL: ln.Addr().String()})
+	defer c.Close()
+
+	var sent time.Time
+	for i := range 3 {
+		// Idle timeout starts once the last request is answered
+		sent = time.Now()
+
+		res, err := c.SendText("/ping", "")
+		if err != nil {
+			t.Fatalf("ERR: Failed to send request %d: %v", i, err)
+		}
+
+		if string(res.Payload) != "pong" {
+			t.Errorf("Unexpected response: %s", string(res.Payload))
+		}
+	}
+
+	first := <-conns
+	for range 2 {
+		if conn := <-conns; conn != first {
+			t.Error("Requests were sent over different connections")
+		}
+	}
+
+	// Idle connection is closed by the server without an error
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Error("ERR: Idle connection failed:", err)
+		}
+
+		if elapsed := time.Since(sent); elapsed < router.IdleTimeout {
+			t.Errorf("Connection was closed after %v, before idle timeout", elapsed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Idle connection wasn't closed")
+	}
+}
+
+func TestRouterCompressesResponses(t *testing.T) {
+	large := strings.Repeat("compressible text ", 1000)
+
+	router := NewRouter()
+	router.AddRoute("/large", func(req *hsp.Request) *hsp.Response {
+		return hsp.NewTextResponse(large)
+	})
+	router.AddRoute("/small", func(req *hsp.Request) *hsp.Response {
+		return hsp.NewTextResponse("small")
+	})
+
+	// Handlers may return the same response to every request
+	shared := hsp.NewTextResponse(large)
+	router.AddRoute("/shared", func(req *hsp.Request) *hsp.Response {
+		return shared
+	})
+
+	for _, tc := range []struct {
+		route    string
+		accepted []string
+		expected string
+	}{
+		{"/large", []string{hsp.CE_GZIP, hsp.CE_DEFLATE}, hsp.CE_GZIP},
+		{"/large", []string{"br", hsp.CE_DEFLATE}, hsp.CE_DEFLATE},
+		{"/large", []string{"br"}, ""},
+		{"/large", nil, ""},
+		{"/small", []string{hsp.CE_GZIP}, ""},
+		{"/shared", []string{hsp.CE_GZIP}, hsp.CE_GZIP},
+		{"/shared", nil, ""},
+	} {
+		headers := hsp.Header{hsp.H_ROUTE: {tc.route}, hsp.H_ACCEPT_ENCODING: tc.accepted}
+		pkt := router.serve(hsp.NewRequest(nil, hsp.BuildPacket(headers, nil)))
+
+		if encoding := pkt.Headers.Get(hsp.H_CONTENT_ENCODING); encoding != tc.expected {
+			t.Errorf("%s accepting %q was encoded with %q, expected %q", tc.route, tc.accepted, encoding, tc.expected)
+		}
+
+		if pkt.HasFlag(hsp.F_COMPRESSED) != (len(tc.expected) > 0) {
+			t.Errorf("%s accepting %q has compressed flag %v", tc.route, tc.accepted, pkt.HasFlag(hsp.F_COMPRESSED))
+		}
+
+		if len(tc.expected) > 0 && len(pkt.Payload) >= len(large) {
+			t.Errorf("Compressed payload is not smaller: %d bytes", len(pkt.Payload))
+		}
+	}
+
+	if string(shared.Payload) != large || shared.Headers.Has(hsp.H_CONTENT_ENCODING) {
+		t.Error("Compression modified response returned by the handler")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("ERR: Failed to listen:", err)
+	}
+
+	addr, err := hsp.ParseAddress(ln.Addr().String())
+	if err != nil {
+		t.Fatal("ERR: Failed to parse address:", err)
+	}
+
+	srv := NewServer(*addr)
+	srv.SetHandler(router)
+
+	go srv.Serve(ln)
+	defer srv.Stop()
+
+	for _, options := range []*client.ClientOptions{
+		{BaseURL: ln.Addr().String()},
+		{BaseURL: ln.Addr().String(), AcceptEncoding: []string{hsp.CE_DEFLATE}},
+		{BaseURL: ln.Addr().String(), DisableCompression: true},
+	} {
+		res, err := client.NewClient(options).SendText("/large", "")
+		if err != nil {
+			t.Fatal("ERR: Failed to send request:", err)
+		}
+
+		if string(res.Payload) != large {
+			t.Error("Response doesn't match the original one")
+		}
+	}
+}
+
+func TestRouterStreamReportsMissingBytes(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("ERR: Failed to listen:", err)
+	}
+
+	addr, err := hsp.ParseAddress(ln.Addr().String())
+	if err != nil {
+		t.Fatal("ERR: Failed to parse address:", err)
+	}
+
+	router := NewRouter()
+	router.MaxStreamSize = 40
+	router.AddStreamRoute("/upload", func(req *hsp.Request, stream *hsp.Stream) *hsp.Response {
+		if _, err := io.Copy(io.Discard, stream); err != nil {
+			return hsp.NewErrorResponse(err)
+		}
+		return nil
+	})
+
+	srv := NewServer(*addr)
+	srv.SetHandler(router)
+
+	go srv.Serve(ln)
+	defer srv.Stop()
+
+	c := client.NewClient(&client.ClientOptions{BaseURL: ln.Addr().String()})
+
+	res, err := c.SendStream("/upload", bytes.NewReader(make([]byte, 100)), 100)
+	if err != nil {
+		t.Fatal("ERR: Failed to send stream:", err)
+	}
+
+	// Counted from the size client wanted to send, not the accepted one
+	if value := res.Headers.Get(hsp.H_STREAM); value != "60:0" {
+		t.Errorf("Expected 60 bytes to be missing, got %q", value)
+	}
+}
+
+func TestRouterSerializesStreamResumes(t *testing.T) {
+	router := NewRouter()
+
+	unlock := router.lockStream("key")
+
+	acquired := make(chan func())
+	go func() {
+		acquired <- router.lockStream("key")
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("Stream was locked twice at once")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Other streams aren't affected
+	router.lockStream("other")()
+
+	unlock()
+
+	select {
+	case unlock := <-acquired:
+		unlock()
+	case <-time.After(time.Second):
+		t.Fatal("Stream wasn't unlocked")
+	}
+
+	if len(router.streamLocks) != 0 {
+		t.Errorf("Locks of finished streams are kept: %d", len(router.streamLocks))
+	}
+}
+
+func TestRequireKeyThroughHandshake(t *testing.T) {
+	authorized, err := hsp.GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate identity:", err)
+	}
+
+	stranger, err := hsp.GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate identity:", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	line := hsp.EncodePublicKey(authorized.Public) + "\tauthorized\n"
+	if err := os.WriteFile(path, []byte(line), 0600); err != nil {
+		t.Fatal("ERR: Failed to write keys:", err)
+	}
+
+	keys, err := hsp.LoadAuthorizedKeys(path)
+	if err != nil {
+		t.Fatal("ERR: Failed to load keys:", err)
+	}
+
+	router := NewRouter()
+	router.AddRoute("/private", RequireKey(keys, func(req *hsp.Request) *hsp.Response {
+		return hsp.NewTextResponse("secret")
+	}))
+
+	for _, handshake := range []hsp.Handshake{hsp.LegacyHandshake, hsp.NoiseXX} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal("ERR: Failed to listen:", err)
+		}
+
+		addr, err := hsp.ParseAddress(ln.Addr().String())
+		if err != nil {
+			t.Fatal("ERR: Failed to parse address:", err)
+		}
+
+		srv := NewServer(*addr)
+		srv.Handshake = handshake
+		srv.SetHandler(router)
+
+		go srv.Serve(ln)
+
+		for _, tc := range []struct {
+			name     string
+			identity *hsp.KeyPair
+			status   int
+		}{
+			{"authorized", authorized, hsp.STATUS_SUCCESS},
+			{"stranger", stranger, hsp.STATUS_UNAUTHORIZED},
+			{"anonymous", nil, hsp.STATUS_UNAUTHORIZED},
+		} {
+			c := client.NewClient(&client.ClientOptions{
+				BaseURL:   ln.Addr().String(),
+				Identity:  tc.identity,
+				Handshake: handshake,
+			})
+
+			res, err := c.SendText("/private", "")
+			if err != nil {
+				t.Fatalf("ERR: Failed to send request of %s client: %v", tc.name, err)
+			}
+
+			if res.StatusCode != tc.status {
+				t.Errorf("Expected status %d for %s client, got %d", tc.status, tc.name, res.StatusCode)
+			}
+
+			c.Close()
+		}
+
+		srv.Stop()
+	}
+}
+
+func TestRouterAnswersMultiplexedRequests(t *testing.T) {
+	conns := make(chan *hsp.Connection, 10)
+
+	router := NewRouter()
+	router.AddRoute("/delay", func(req *hsp.Request) *hsp.Response {
+		conns <- req.Conn()
+
+		delay, err := time.ParseDuration(string(req.GetRawPacket().Payload))
+		if err != nil {
+			return hsp.NewErrorResponse(err)
+		}
+
+		time.Sleep(delay)
+		return hsp.NewTextResponse(string(req.GetRawPacket().Payload))
+	})
+	router.AddRoute("/panic", func(req *hsp.Request) *hsp.Response {
+		panic("boom")
+	})
+
+	ln, srv := listen(t)
+	srv.SetHandler(router)
+
+	go srv.Serve(ln)
+
+	c := client.NewClient(&client.ClientOptions{BaseURL: ln.Addr().String(), Multiplex: true})
+	defer c.Close()
+
+	// Connection is established before the concurrent requests
+	if _, err := c.SendText("/delay", "0s"); err != nil {
+		t.Fatal("ERR: Failed to send request:", err)
+	}
+
+	delays := []string{"300ms", "0s", "150ms"}
+	done := make(chan string, len(delays))
+	errs := make(chan error, len(delays))
+
+	for i, delay := range delays {
+		go func() {
+			res, err := c.SendText("/delay", delay)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			if string(res.Payload) != delay {
+				errs <- fmt.Errorf("response to request %d doesn't match: %s", i, string(res.Payload))
+				return
+			}
+
+			done <- delay
+		}()
+
+		// Requests reach the server in order of delays
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	var order []string
+	for range delays {
+		select {
+		case delay := <-done:
+			order = append(order, delay)
+		case err := <-errs:
+			t.Fatal("ERR: Failed to send request:", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Responses weren't received")
+		}
+	}
+
+	// Faster requests are answered before the slower ones sent earlier
+	if !slices.Equal(order, []string{"0s", "150ms", "300ms"}) {
+		t.Errorf("Unexpected order of responses: %q", order)
+	}
+
+	first := <-conns
+	for range delays {
+		if conn := <-conns; conn != first {
+			t.Error("Requests were sent over different connections")
+		}
+	}
+
+	// Panic of a handler fails only its request
+	res, err := c.SendText("/panic", "")
+	if err != nil {
+		t.Fatal("ERR: Failed to send request:", err)
+	}
+
+	if res.StatusCode != hsp.STATUS_INTERNALERR {
+		t.Errorf("Expected internal error, got status %d", res.StatusCode)
+	}
+
+	res, err = c.SendText("/delay", "0s")
+	if err != nil {
+		t.Fatal("ERR: Server stopped serving after panic:", err)
+	}
+
+	if string(res.Payload) != "0s" {
+		t.Errorf("Unexpected response: %s", string(res.Payload))
+	}
+
+	if conn := <-conns; conn != first {
+		t.Error("Connection was closed after panic")
+	}
+}
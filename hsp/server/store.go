@@ -0,0 +1,195 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var ErrUnknownStream = errors.New("unknown stream")
+
+// Unfinished streams which weren't resumed for this long are forgotten
+const DefaultStreamTTL = 24 * time.Hour
+
+type StreamState struct {
+	Key    string `json:"key"`
+	Route  string `json:"route"`
+	Format string `json:"format"`
+	// Amount of bytes server accepts, may be less than requested
+	Total int64 `json:"total"`
+	// Amount of bytes client wanted to send
+	Requested int64 `json:"requested"`
+	Received  int64 `json:"received"`
+}
+
+// Remaining returns amount of bytes server still expects
+func (s *StreamState) Remaining() int64 {
+	return s.Total - s.Received
+}
+
+// Missing returns amount of client's bytes which didn't arrive
+func (s *StreamState) Missing() int64 {
+	return max(s.Requested, s.Total) - s.Received
+}
+
+// StreamStore keeps track of partially transferred streams, so they can be
+// resumed using their x-stream-key after a loss of connection
+type StreamStore interface {
+	Load(key string) (*StreamState, error)
+	Save(state *StreamState) error
+	Delete(key string) error
+}
+
+type memoryStreamEntry struct {
+	state StreamState
+	saved time.Time
+}
+
+type MemoryStreamStore struct {
+	// States not saved for this long are dropped, 0 keeps them forever
+	TTL    time.Duration
+	states map[string]memoryStreamEntry
+	mu     sync.Mutex
+}
+
+func NewMemoryStreamStore() *MemoryStreamStore {
+	return &MemoryStreamStore{
+		TTL:    DefaultStreamTTL,
+		states: make(map[string]memoryStreamEntry),
+	}
+}
+
+func (m *MemoryStreamStore) expired(entry memoryStreamEntry, now time.Time) bool {
+	return m.TTL > 0 && now.Sub(entry.saved) > m.TTL
+}
+
+func (m *MemoryStreamStore) Load(key string) (*StreamState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.states[key]
+	if !ok {
+		return nil, ErrUnknownStream
+	}
+
+	if m.expired(entry, time.Now()) {
+		delete(m.states, key)
+		return nil, ErrUnknownStream
+	}
+
+	return &entry.state, nil
+}
+
+// Save also drops expired states, so abandoned streams don't pile up
+func (m *MemoryStreamStore) Save(state *StreamState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for key, entry := range m.states {
+		if m.expired(entry, now) {
+			delete(m.states, key)
+		}
+	}
+
+	m.states[state.Key] = memoryStreamEntry{state: *state, saved: now}
+	return nil
+}
+
+func (m *MemoryStreamStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.states, key)
+	return nil
+}
+
+type FileStreamStore struct {
+	Dir string
+	mu  sync.Mutex
+}
+
+func NewFileStreamStore(dir string) (*FileStreamStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	return &FileStreamStore{
+		Dir: dir,
+	}, nil
+}
+
+func (f *FileStreamStore) path(key string) (string, error) {
+	// Keys come from the peer, so make sure they can't escape the directory
+	if _, err := hex.DecodeString(key); err != nil || len(key) == 0 {
+		return "", ErrUnknownStream
+	}
+	return filepath.Join(f.Dir, key+".json"), nil
+}
+
+func (f *FileStreamStore) Load(key string) (*StreamState, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrUnknownStream
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := &StreamState{}
+	if err := json.Unmarshal(raw, state); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+func (f *FileStreamStore) Save(state *StreamState) error {
+	path, err := f.path(state.Key)
+	if err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func (f *FileStreamStore) Delete(key string) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFileStreamStore(t *testing.T) {
+	store, err := NewFileStreamStore(t.TempDir())
+	if err != nil {
+		t.Fatal("ERR: Failed to create store:", err)
+	}
+
+	state := &StreamState{
+		Key:      "0be3088c061251167c28d992e2623adc",
+		Route:    "/upload",
+		Format:   "bytes",
+		Total:    20000,
+		Received: 4096,
+	}
+
+	if err := store.Save(state); err != nil {
+		t.Fatal("ERR: Failed to save state:", err)
+	}
+
+	loaded, err := store.Load(state.Key)
+	if err != nil {
+		t.Fatal("ERR: Failed to load state:", err)
+	}
+
+	if *loaded != *state {
+		t.Errorf("Loaded state %+v doesn't match saved one %+v", loaded, state)
+	}
+
+	if err := store.Delete(state.Key); err != nil {
+		t.Fatal("ERR: Failed to delete state:", err)
+	}
+
+	if _, err := store.Load(state.Key); !errors.Is(err, ErrUnknownStream) {
+		t.Error("Expected unknown stream after delete, got:", err)
+	}
+
+	if _, err := store.Load("../../etc/passwd"); !errors.Is(err, ErrUnknownStream) {
+		t.Error("Expected invalid key to be rejected, got:", err)
+	}
+}
+
+func TestMemoryStreamStoreExpires(t *testing.T) {
+	store := NewMemoryStreamStore()
+	store.TTL = 10 * time.Millisecond
+
+	state := &StreamState{Key: "old", Route: "/upload", Total: 20000, Requested: 20000}
+	if err := store.Save(state); err != nil {
+		t.Fatal("ERR: Failed to save state:", err)
+	}
+
+	if loaded, err := store.Load(state.Key); err != nil || *loaded != *state {
+		t.Fatal("ERR: Failed to load fresh state:", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if err := store.Save(&StreamState{Key: "new"}); err != nil {
+		t.Fatal("ERR: Failed to save state:", err)
+	}
+
+	if len(store.states) != 1 {
+		t.Errorf("Expired states weren't dropped on save: %d left", len(store.states))
+	}
+
+	if _, err := store.Load(state.Key); !errors.Is(err, ErrUnknownStream) {
+		t.Error("Expected expired stream to be unknown, got:", err)
+	}
+}
@@ -0,0 +1,114 @@
+package hsp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const DefaultStreamBufferSize = 4096
+
+var ErrStreamOverflow = errors.New("stream data exceeds the stream size")
+
+// Stream reads data of a stream request. Data is sent in packets without
+// headers, one per portion, so it is encrypted like any other packet.
+type Stream struct {
+	Key string
+	// Amount of bytes received during previous attempts of the same stream
+	Offset     int64
+	Size       int64
+	BufferSize int
+	received   int64
+	conn       *Connection
+	// Part of the last packet which wasn't read yet
+	chunk []byte
+}
+
+func NewStream(conn *Connection, key string, offset, size int64, bufferSize int) *Stream {
+	return &Stream{
+		Key:        key,
+		Offset:     offset,
+		Size:       size,
+		BufferSize: bufferSize,
+		conn:       conn,
+	}
+}
+
+func NewStreamKey() (string, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// ParseStreamHeader parses the value of x-stream header, which holds two
+// numbers separated with colon, e.g. "20000:4096". A single number is
+// allowed as well, in which case the second one is 0.
+func ParseStreamHeader(value string) (int64, int64, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) > 2 {
+		return 0, 0, fmt.Errorf("invalid stream header: %s", value)
+	}
+
+	first, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid stream header: %s", value)
+	}
+
+	if len(parts) == 1 {
+		return first, 0, nil
+	}
+
+	second, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid stream header: %s", value)
+	}
+
+	return first, second, nil
+}
+
+func FormatStreamHeader(first, second int64) string {
+	return fmt.Sprintf("%d:%d", first, second)
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	remaining := s.Remaining()
+	if remaining <= 0 {
+		return 0, io.EOF
+	}
+
+	for len(s.chunk) == 0 {
+		pkt, err := s.conn.Read()
+		if errors.Is(err, io.EOF) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if int64(len(pkt.Payload)) > remaining {
+			return 0, fmt.Errorf("%w: %d bytes expected, got %d", ErrStreamOverflow, remaining, len(pkt.Payload))
+		}
+
+		s.chunk = pkt.Payload
+	}
+
+	n := copy(p, s.chunk)
+	s.chunk = s.chunk[n:]
+	s.received += int64(n)
+
+	return n, nil
+}
+
+func (s *Stream) Received() int64 {
+	return s.received
+}
+
+func (s *Stream) Remaining() int64 {
+	return s.Size - s.received
+}
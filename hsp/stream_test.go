@@ -0,0 +1,68 @@
+package hsp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+)
+
+func TestStreamReadsEncryptedPackets(t *testing.T) {
+	keys, err := DeriveSessionKeys([]byte("secret"), []byte("transcript"))
+	if err != nil {
+		t.Fatal("ERR: Failed to derive keys:", err)
+	}
+
+	conn := &bufferConn{}
+	sender := NewConnection(conn, nil, keys.ClientToServer, keys.ServerToClient)
+	receiver := NewConnection(conn, nil, keys.ServerToClient, keys.ClientToServer)
+
+	data := []byte("secret stream data, sent in portions")
+	for portion := range slices.Chunk(data, 8) {
+		if _, err := sender.Write(BuildPacket(Header{}, portion)); err != nil {
+			t.Fatal("ERR: Failed to write portion:", err)
+		}
+	}
+
+	if bytes.Contains(conn.buf.Bytes(), []byte("secret")) {
+		t.Error("Stream data is sent in plaintext")
+	}
+
+	stream := NewStream(receiver, "key", 0, int64(len(data)), 8)
+
+	// Reads don't have to match the portions
+	received, err := io.ReadAll(io.LimitReader(stream, 5))
+	if err != nil {
+		t.Fatal("ERR: Failed to read stream:", err)
+	}
+
+	rest, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal("ERR: Failed to read stream:", err)
+	}
+
+	if !bytes.Equal(append(received, rest...), data) {
+		t.Errorf("Unexpected stream data: %q", append(received, rest...))
+	}
+
+	if stream.Received() != int64(len(data)) || stream.Remaining() != 0 {
+		t.Errorf("Unexpected amount of received data: %d", stream.Received())
+	}
+
+	// Portion larger than the rest of the stream
+	if _, err := sender.Write(BuildPacket(Header{}, data)); err != nil {
+		t.Fatal("ERR: Failed to write portion:", err)
+	}
+
+	stream = NewStream(receiver, "key", 0, 4, 8)
+	if _, err := stream.Read(make([]byte, 8)); !errors.Is(err, ErrStreamOverflow) {
+		t.Error("Expected stream overflow, got:", err)
+	}
+
+	// Connection ends before the whole stream
+	stream = NewStream(receiver, "key", 0, 4, 8)
+	if _, err := stream.Read(make([]byte, 8)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("Expected unexpected EOF, got:", err)
+	}
+}
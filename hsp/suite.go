@@ -0,0 +1,92 @@
+package hsp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"slices"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+type CipherSuite uint8
+
+const (
+	SUITE_NONE              CipherSuite = 0
+	SUITE_AES_256_GCM       CipherSuite = 1
+	SUITE_CHACHA20_POLY1305 CipherSuite = 2
+)
+
+var ErrNoCommonSuite = errors.New("no cipher suite supported by both sides")
+
+// DefaultCipherSuites are offered by clients and accepted by servers in
+// order of preference when nothing else is configured
+var DefaultCipherSuites = []CipherSuite{
+	SUITE_AES_256_GCM,
+	SUITE_CHACHA20_POLY1305,
+}
+
+func (s CipherSuite) String() string {
+	switch s {
+	case SUITE_AES_256_GCM:
+		return "AES-256-GCM"
+	case SUITE_CHACHA20_POLY1305:
+		return "ChaCha20-Poly1305"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(s))
+	}
+}
+
+func (s CipherSuite) NewAEAD(key []byte) (cipher.AEAD, error) {
+	switch s {
+	case SUITE_AES_256_GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case SUITE_CHACHA20_POLY1305:
+		return chacha20poly1305.New(key)
+	default:
+		return nil, fmt.Errorf("unsupported cipher suite: %s", s.String())
+	}
+}
+
+func (s CipherSuite) Seal(key, nonce, data, additionalData []byte) ([]byte, error) {
+	aead, err := s.NewAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nil, nonce, data, additionalData), nil
+}
+
+func (s CipherSuite) Open(key, nonce, encrypted, additionalData []byte) ([]byte, error) {
+	aead, err := s.NewAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Open(nil, nonce, encrypted, additionalData)
+}
+
+func ParseCipherSuite(name string) (CipherSuite, error) {
+	for _, suite := range []CipherSuite{SUITE_AES_256_GCM, SUITE_CHACHA20_POLY1305} {
+		if suite.String() == name {
+			return suite, nil
+		}
+	}
+	return SUITE_NONE, fmt.Errorf("unknown cipher suite: %s", name)
+}
+
+// SelectCipherSuite picks the first of the server's preferred suites which
+// is offered by the client
+func SelectCipherSuite(preferred, offered []CipherSuite) CipherSuite {
+	for _, suite := range preferred {
+		if slices.Contains(offered, suite) {
+			return suite
+		}
+	}
+	return SUITE_NONE
+}
@@ -0,0 +1,210 @@
+package hsp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTicketLifetime    = 24 * time.Hour
+	DefaultTicketKeyRotation = 6 * time.Hour
+)
+
+var ErrInvalidTicket = errors.New("session ticket is invalid or expired")
+
+type ticketKey struct {
+	ID      [4]byte
+	Key     [32]byte
+	Created time.Time
+}
+
+// TicketKeys encrypts session tickets issued by the server. Key is replaced
+// every rotation interval, older keys are kept until tickets sealed with them
+// expire.
+type TicketKeys struct {
+	Lifetime time.Duration
+	Rotation time.Duration
+	// Newest key goes first
+	keys []ticketKey
+	mu   sync.Mutex
+}
+
+func NewTicketKeys(lifetime, rotation time.Duration) *TicketKeys {
+	return &TicketKeys{
+		Lifetime: lifetime,
+		Rotation: rotation,
+	}
+}
+
+// Session state sealed inside of a ticket, only the server can read it
+type ticketState struct {
+	Created  time.Time
+	Secret   [32]byte
+	Identity *[32]byte
+}
+
+func (k *TicketKeys) current(now time.Time) (ticketKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.expire(now)
+
+	if len(k.keys) > 0 && (k.Rotation <= 0 || now.Sub(k.keys[0].Created) < k.Rotation) {
+		return k.keys[0], nil
+	}
+
+	key := ticketKey{Created: now}
+	if _, err := rand.Read(key.ID[:]); err != nil {
+		return key, err
+	}
+	if _, err := rand.Read(key.Key[:]); err != nil {
+		return key, err
+	}
+
+	k.keys = append([]ticketKey{key}, k.keys...)
+
+	return key, nil
+}
+
+func (k *TicketKeys) lookup(id []byte, now time.Time) (ticketKey, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.expire(now)
+
+	for _, key := range k.keys {
+		if string(key.ID[:]) == string(id) {
+			return key, true
+		}
+	}
+
+	return ticketKey{}, false
+}
+
+// Keys stop being used for new tickets after rotation interval, so the last
+// ticket sealed with a key expires one lifetime later
+func (k *TicketKeys) expire(now time.Time) {
+	if k.Rotation <= 0 {
+		return
+	}
+
+	for i, key := range k.keys {
+		if now.Sub(key.Created) >= k.Rotation+k.Lifetime {
+			k.keys = k.keys[:i]
+			return
+		}
+	}
+}
+
+// Ticket layout: key id (4), nonce (12), encrypted state with tag
+func (k *TicketKeys) seal(state *ticketState) ([]byte, error) {
+	key, err := k.current(state.Created)
+	if err != nil {
+		return nil, err
+	}
+
+	plain := binary.BigEndian.AppendUint64(nil, uint64(state.Created.Unix()))
+	plain = append(plain, state.Secret[:]...)
+	if state.Identity != nil {
+		plain = append(append(plain, 1), state.Identity[:]...)
+	} else {
+		plain = append(plain, 0)
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	sealed, err := Seal(key.Key[:], nonce, plain, key.ID[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return concat(key.ID[:], nonce, sealed), nil
+}
+
+func (k *TicketKeys) open(ticket []byte, now time.Time) (*ticketState, error) {
+	if len(ticket) < 4+nonceSize+tagSize {
+		return nil, ErrInvalidTicket
+	}
+
+	key, ok := k.lookup(ticket[:4], now)
+	if !ok {
+		return nil, ErrInvalidTicket
+	}
+
+	plain, err := Open(key.Key[:], ticket[4:4+nonceSize], ticket[4+nonceSize:], ticket[:4])
+	if err != nil || len(plain) < 41 {
+		return nil, ErrInvalidTicket
+	}
+
+	state := &ticketState{
+		Created: time.Unix(int64(binary.BigEndian.Uint64(plain[:8])), 0),
+		Secret:  [32]byte(plain[8:40]),
+	}
+
+	switch {
+	case plain[40] == 1 && len(plain) == 73:
+		identity := [32]byte(plain[41:73])
+		state.Identity = &identity
+	case plain[40] != 0 || len(plain) != 41:
+		return nil, ErrInvalidTicket
+	}
+
+	if k.Lifetime > 0 && now.Sub(state.Created) >= k.Lifetime {
+		return nil, ErrInvalidTicket
+	}
+
+	return state, nil
+}
+
+// ClientSession is remembered by the client to resume the session later
+type ClientSession struct {
+	Ticket []byte
+	Secret [32]byte
+	// Resumed session has to be confirmed by the same server
+	ServerIdentity [32]byte
+	Expires        time.Time
+}
+
+// ClientSessionCache keeps sessions by server address, putting nil
+// session removes it
+type ClientSessionCache interface {
+	Get(host string) (*ClientSession, bool)
+	Put(host string, session *ClientSession)
+}
+
+type MemorySessionCache struct {
+	sessions map[string]*ClientSession
+	mu       sync.Mutex
+}
+
+func NewMemorySessionCache() *MemorySessionCache {
+	return &MemorySessionCache{
+		sessions: make(map[string]*ClientSession),
+	}
+}
+
+func (c *MemorySessionCache) Get(host string) (*ClientSession, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	session, ok := c.sessions[host]
+	return session, ok
+}
+
+func (c *MemorySessionCache) Put(host string, session *ClientSession) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if session == nil {
+		delete(c.sessions, host)
+		return
+	}
+
+	c.sessions[host] = session
+}
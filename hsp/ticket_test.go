@@ -0,0 +1,126 @@
+package hsp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionResumption(t *testing.T) {
+	identity, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate identity:", err)
+	}
+
+	clientIdentity, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal("ERR: Failed to generate client identity:", err)
+	}
+
+	serverConfig := &ServerConfig{Identity: identity, Tickets: NewTicketKeys(time.Hour, time.Hour)}
+	clientConfig := &ClientConfig{Host: "localhost:998", Identity: clientIdentity, SessionCache: NewMemorySessionCache()}
+
+	server, client, err := handshake(t, serverConfig, clientConfig)
+	if err != nil {
+		t.Fatal("ERR: Handshake failed:", err)
+	}
+
+	if server.Resumed || client.Resumed {
+		t.Error("First handshake can't be resumed")
+	}
+
+	// Ticket arrives along with the first packet of the server
+	done := make(chan error, 1)
+	go func() {
+		_, err := server.Write(BuildPacket(Header{}, []byte("hello")))
+		done <- err
+	}()
+
+	if _, err := client.Read(); err != nil {
+		t.Fatal("ERR: Failed to read packet:", err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal("ERR: Failed to write packet:", err)
+	}
+
+	if _, ok := clientConfig.SessionCache.Get("localhost:998"); !ok {
+		t.Fatal("Client didn't remember the session ticket")
+	}
+
+	server, client, err = handshake(t, serverConfig, clientConfig)
+	if err != nil {
+		t.Fatal("ERR: Resumed handshake failed:", err)
+	}
+
+	if !server.Resumed || !client.Resumed {
+		t.Error("Session wasn't resumed")
+	}
+
+	if server.SendKey != client.RecvKey || server.RecvKey != client.SendKey {
+		t.Error("Server and client derived different keys")
+	}
+
+	if server.PeerIdentity == nil || *server.PeerIdentity != clientIdentity.Public {
+		t.Error("Resumed session lost the client identity")
+	}
+
+	// Ticket was used up, so the next handshake is a full one
+	server, client, err = handshake(t, serverConfig, clientConfig)
+	if err != nil {
+		t.Fatal("ERR: Handshake failed:", err)
+	}
+
+	if server.Resumed || client.Resumed {
+		t.Error("Ticket was used twice")
+	}
+}
+
+func TestTicketKeysRotation(t *testing.T) {
+	keys := NewTicketKeys(time.Hour, 2*time.Hour)
+
+	now := time.Now()
+	state := &ticketState{Created: now, Secret: [32]byte{1}}
+
+	ticket, err := keys.seal(state)
+	if err != nil {
+		t.Fatal("ERR: Failed to seal ticket:", err)
+	}
+
+	opened, err := keys.open(ticket, now.Add(30*time.Minute))
+	if err != nil {
+		t.Fatal("ERR: Failed to open ticket:", err)
+	}
+
+	if opened.Secret != state.Secret || opened.Identity != nil {
+		t.Error("Ticket state was changed")
+	}
+
+	tampered := append([]byte{}, ticket...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := keys.open(tampered, now); err == nil {
+		t.Error("Tampered ticket was accepted")
+	}
+
+	if _, err := keys.open(ticket, now.Add(2*time.Hour)); err == nil {
+		t.Error("Expired ticket was accepted")
+	}
+
+	// Sealing after rotation interval replaces the key
+	later := &ticketState{Created: now.Add(150 * time.Minute), Secret: [32]byte{2}}
+	if _, err := keys.seal(later); err != nil {
+		t.Fatal("ERR: Failed to seal ticket:", err)
+	}
+
+	if len(keys.keys) != 2 || keys.keys[0].ID == keys.keys[1].ID {
+		t.Error("Ticket key wasn't rotated")
+	}
+
+	// Old key is dropped once all of its tickets have expired
+	if _, err := keys.seal(&ticketState{Created: now.Add(4 * time.Hour)}); err != nil {
+		t.Fatal("ERR: Failed to seal ticket:", err)
+	}
+
+	if len(keys.keys) != 1 {
+		t.Errorf("Expected 1 ticket key, got %d", len(keys.keys))
+	}
+}